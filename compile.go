@@ -0,0 +1,258 @@
+package request_marker
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// compiledRule holds the parts of a rule that are expensive to build, such as
+// regular expressions. They are prepared once when rules are loaded so that
+// ServeHTTP never compiles anything on the request path.
+type compiledRule struct {
+	pathRegexp  *regexp.Regexp
+	valueRegexp *regexp.Regexp
+	cidrs       *ipTrie
+	startAt     time.Time
+	endAt       time.Time
+	schedules   []*compiledSchedule
+	versions    versionConstraint
+	platforms   map[string]versionConstraint
+	userIDs     map[string]struct{}
+	cohort      uint64 // userIdsKey 成员的摘要，成员变化时快照版本随之变化
+	tags        []string
+}
+
+func newCompiledRule(r Rule) (*compiledRule, error) {
+	c := &compiledRule{tags: ruleTags(r)}
+	if r.Type == RuleTypePath && r.PathMatch == PathMatchRegex {
+		re, err := regexp.Compile(r.Path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path regex %q: %w", r.Path, err)
+		}
+		c.pathRegexp = re
+	}
+	if r.Operator == MatchOperatorRegex && len(r.Values) > 0 {
+		re, err := regexp.Compile(r.Values[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value regex %q: %w", r.Values[0], err)
+		}
+		c.valueRegexp = re
+	}
+	if r.Type == RuleTypeIdentify {
+		c.userIDs = make(map[string]struct{}, len(r.UserIds))
+		for _, userID := range r.UserIds {
+			c.userIDs[userID] = struct{}{}
+		}
+	}
+	if r.Type == RuleTypeIP {
+		trie, err := newIPTrie(r.CIDRs)
+		if err != nil {
+			return nil, err
+		}
+		c.cidrs = trie
+	}
+	if r.Type == RuleTypeVersion {
+		if r.MinVersion != "" || r.MaxVersion != "" || r.VersionConstraint != "" {
+			versions, err := compileVersionRange(r.MinVersion, r.MaxVersion, r.MinExclusive, r.MaxExclusive, r.VersionConstraint)
+			if err != nil {
+				return nil, err
+			}
+			c.versions = versions
+		}
+		platforms, err := compilePlatformVersions(r.PlatformVersions)
+		if err != nil {
+			return nil, err
+		}
+		c.platforms = platforms
+	}
+	if r.StartAt != "" {
+		startAt, err := parseTimestamp(r.StartAt)
+		if err != nil {
+			return nil, err
+		}
+		c.startAt = startAt
+	}
+	if r.EndAt != "" {
+		endAt, err := parseTimestamp(r.EndAt)
+		if err != nil {
+			return nil, err
+		}
+		c.endAt = endAt
+	}
+	for _, schedule := range r.Schedules {
+		compiled, err := compileSchedule(schedule)
+		if err != nil {
+			return nil, err
+		}
+		c.schedules = append(c.schedules, compiled)
+	}
+	return c, nil
+}
+
+// ruleTags merges the comma-separated tag with the tags list. A rule without
+// any tag only serves a middleware without tag.
+func ruleTags(r Rule) []string {
+	var tags []string
+	for _, tag := range append(strings.Split(r.Tag, ","), r.Tags...) {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		return []string{""}
+	}
+	return tags
+}
+
+// hasTag reports whether the rule serves a middleware configured with tag.
+func (r Rule) hasTag(tag string) bool {
+	for _, t := range r.matchers().tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// compile prepares the rule's matchers. It must be called after Validate.
+func (r *Rule) compile() error {
+	c, err := newCompiledRule(*r)
+	if err != nil {
+		return err
+	}
+	r.compiled = c
+	if r.Conditions != nil {
+		return r.Conditions.compile()
+	}
+	return nil
+}
+
+func (c *Condition) compile() error {
+	for i := range c.All {
+		if err := c.All[i].compile(); err != nil {
+			return err
+		}
+	}
+	for i := range c.Any {
+		if err := c.Any[i].compile(); err != nil {
+			return err
+		}
+	}
+	if c.Not != nil {
+		return c.Not.compile()
+	}
+	if c.Type != "" {
+		return c.Rule.compile()
+	}
+	return nil
+}
+
+// walk calls fn for the rule and every leaf of its condition tree.
+func (r *Rule) walk(fn func(*Rule) error) error {
+	if err := fn(r); err != nil {
+		return err
+	}
+	if r.Conditions != nil {
+		return r.Conditions.walk(fn)
+	}
+	return nil
+}
+
+func (c *Condition) walk(fn func(*Rule) error) error {
+	for i := range c.All {
+		if err := c.All[i].walk(fn); err != nil {
+			return err
+		}
+	}
+	for i := range c.Any {
+		if err := c.Any[i].walk(fn); err != nil {
+			return err
+		}
+	}
+	if c.Not != nil {
+		return c.Not.walk(fn)
+	}
+	if c.Type != "" {
+		return c.Rule.walk(fn)
+	}
+	return nil
+}
+
+// loadsCohort reports whether the members of the rule's userIdsKey are loaded
+// into memory when rules are refreshed, rather than looked up per request.
+func (r *Rule) loadsCohort() bool {
+	return r.Type == RuleTypeIdentify && r.UserIdsKey != "" && r.UserIdsLookup != UserIdsLookupLive
+}
+
+// validateStaticCohorts checks the userIdsKey sets of a static rule. Static
+// rules are never refreshed from Redis, so their sets can only be looked up
+// live, which in turn requires Redis to be configured.
+func validateStaticCohorts(rule *Rule, redisEnabled bool) error {
+	return rule.walk(func(r *Rule) error {
+		if r.loadsCohort() {
+			return fmt.Errorf("userIdsKey %s is only loaded for Redis rules, use userIdsLookup live instead", r.UserIdsKey)
+		}
+		if r.UserIdsLookup == UserIdsLookupLive && !redisEnabled {
+			return fmt.Errorf("userIdsLookup live of userIdsKey %s requires redisConfig", r.UserIdsKey)
+		}
+		return nil
+	})
+}
+
+// matchers returns the precompiled matchers of the rule, building them on the
+// fly for rules that were never compiled (e.g. constructed directly in code).
+func (r Rule) matchers() *compiledRule {
+	if r.compiled != nil {
+		return r.compiled
+	}
+	c, err := newCompiledRule(r)
+	if err != nil {
+		return &compiledRule{}
+	}
+	return c
+}
+
+func compilePlatformVersions(platformVersions []PlatformVersion) (map[string]versionConstraint, error) {
+	if len(platformVersions) == 0 {
+		return nil, nil
+	}
+	platforms := make(map[string]versionConstraint, len(platformVersions))
+	for _, pv := range platformVersions {
+		platform := strings.ToLower(strings.TrimSpace(pv.Platform))
+		if platform == "" {
+			return nil, fmt.Errorf("platform version requires platform")
+		}
+		if _, ok := platforms[platform]; ok {
+			return nil, fmt.Errorf("duplicate platform version for %s", platform)
+		}
+		if pv.MinVersion == "" && pv.MaxVersion == "" && pv.VersionConstraint == "" {
+			return nil, fmt.Errorf("platform version for %s requires minVersion, maxVersion or versionConstraint", platform)
+		}
+		versions, err := compileVersionRange(pv.MinVersion, pv.MaxVersion, pv.MinExclusive, pv.MaxExclusive, pv.VersionConstraint)
+		if err != nil {
+			return nil, fmt.Errorf("platform %s: %w", platform, err)
+		}
+		platforms[platform] = versions
+	}
+	return platforms, nil
+}
+
+func validatePathMatch(mode PathMatch, pattern string) error {
+	switch mode {
+	case "", PathMatchExact, PathMatchPrefix:
+	case PathMatchGlob:
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid path glob %q: %w", pattern, err)
+		}
+	case PathMatchRegex:
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid path regex %q: %w", pattern, err)
+		}
+	default:
+		return fmt.Errorf("unknown path match mode: %s", mode)
+	}
+	return nil
+}
@@ -1,21 +1,83 @@
 package request_marker
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/qxsugar/request-marker/redis"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type RuleType string
 
 const (
-	RuleTypePath     = RuleType("path")
-	RuleTypeVersion  = RuleType("version")
-	RuleTypeIdentify = RuleType("identify")
-	RuleTypeCanary   = RuleType("canary")
+	RuleTypePath      = RuleType("path")
+	RuleTypeVersion   = RuleType("version")
+	RuleTypeIdentify  = RuleType("identify")
+	RuleTypeCanary    = RuleType("canary")
+	RuleTypeComposite = RuleType("composite")
+	RuleTypeHeader    = RuleType("header")
+	RuleTypeCookie    = RuleType("cookie")
+	RuleTypeQuery     = RuleType("query")
+	RuleTypeIP        = RuleType("ip")
+	RuleTypeClaim     = RuleType("claim")
+	RuleTypeSplit     = RuleType("split")
 )
 
+type MatchOperator string
+
+const (
+	MatchOperatorEquals = MatchOperator("equals")
+	MatchOperatorIn     = MatchOperator("in")
+	MatchOperatorRegex  = MatchOperator("regex")
+	MatchOperatorExists = MatchOperator("exists")
+	MatchOperatorAbsent = MatchOperator("absent")
+)
+
+type PathMatch string
+
+const (
+	PathMatchExact  = PathMatch("exact")
+	PathMatchPrefix = PathMatch("prefix")
+	PathMatchGlob   = PathMatch("glob")
+	PathMatchRegex  = PathMatch("regex")
+)
+
+type UserIdsLookup string
+
+const (
+	UserIdsLookupLoad = UserIdsLookup("load")
+	UserIdsLookupLive = UserIdsLookup("live")
+)
+
+type IdentifyFallback string
+
+const (
+	IdentifyFallbackIP      = IdentifyFallback("ip")
+	IdentifyFallbackHeaders = IdentifyFallback("headers")
+	IdentifyFallbackRandom  = IdentifyFallback("random")
+)
+
+type IdentifySourceType string
+
+const (
+	IdentifySourceHeader = IdentifySourceType("header")
+	IdentifySourceCookie = IdentifySourceType("cookie")
+	IdentifySourceQuery  = IdentifySourceType("query")
+	IdentifySourceJWT    = IdentifySourceType("jwt")
+	IdentifySourceIP     = IdentifySourceType("ip")
+	IdentifySourcePath   = IdentifySourceType("path")
+)
+
+// canaryBuckets is the number of hash buckets canary rules are evaluated
+// against, giving a granularity of one basis point.
+const canaryBuckets = 10000
+
 const (
+	FieldTag        = "tag"
 	FieldName       = "name"
 	FieldEnable     = "enable"
 	FieldPriority   = "priority"
@@ -25,76 +87,483 @@ const (
 	FieldMaxVersion = "max_version"
 	FieldUserIds    = "user_ids"
 	FieldWeight     = "weight"
+	FieldCanary     = "canary"
 	FieldPath       = "path"
+	FieldPathMatch  = "path_match"
+	FieldConditions = "conditions"
+	FieldKey        = "key"
+	FieldOperator   = "operator"
+	FieldValues     = "values"
+	FieldCIDRs      = "cidrs"
+	FieldMethods    = "methods"
+	FieldHosts      = "hosts"
+	FieldStartAt    = "start_at"
+	FieldEndAt      = "end_at"
+	FieldSchedules  = "schedules"
+
+	FieldMinExclusive      = "min_exclusive"
+	FieldMaxExclusive      = "max_exclusive"
+	FieldVersionConstraint = "version_constraint"
+	FieldPlatformVersions  = "platform_versions"
+	FieldVariants          = "variants"
+	FieldSalt              = "salt"
+	FieldCanaryBps         = "canary_bps"
+	FieldBuckets           = "buckets"
+	FieldUserIdsKey        = "user_ids_key"
+	FieldUserIdsLookup     = "user_ids_lookup"
+	FieldFailOpen          = "fail_open"
+
+	// FieldJSON holds the whole rule as a JSON document, see parseRuleJSON
+	FieldJSON = "json"
 )
 
+// ruleSchemaVersion is the version of the JSON rule document format. Documents
+// carry it in schemaVersion so that a middleware rejects documents written for
+// a newer format instead of silently misreading them.
+const ruleSchemaVersion = 1
+
 type Rule struct {
-	Tag         string   `json:"tag"`         // tag，当rule.tag和config.tag匹配时候，才会使用这个规则
-	Name        string   `json:"name"`        // 规则名字
-	Enable      bool     `json:"enable"`      // 是否开启
-	Priority    int      `json:"priority"`    // 优先级，越高越优先
-	Type        RuleType `json:"type"`        // 规则类型
-	MarkerValue string   `json:"markerValue"` // 标记值
-	MaxVersion  string   `json:"maxVersion"`  // RuleTypeVersion: 最大版本
-	MinVersion  string   `json:"minVersion"`  // RuleTypeVersion: 最小版本
-	UserIds     []string `json:"userIds"`     // RuleTypeIdentify: 适用的用户ID列表
-	Canary      int      `json:"Canary"`      // RuleTypeCanary: 流量百分比（0-100）
-	Path        string   `json:"path"`        // RuleTypePath: URI路径匹配规则
+	Tag         string        `json:"tag" yaml:"tag"`                 // tag，当rule.tag和config.tag匹配时候，才会使用这个规则，多个 tag 用逗号分隔
+	Tags        []string      `json:"tags" yaml:"tags"`               // 可选，额外的 tag 列表，与 tag 合并后命中任一即可
+	Name        string        `json:"name" yaml:"name"`               // 规则名字
+	Enable      bool          `json:"enable" yaml:"enable"`           // 是否开启
+	Priority    int           `json:"priority" yaml:"priority"`       // 优先级，越高越优先
+	Type        RuleType      `json:"type" yaml:"type"`               // 规则类型
+	MarkerValue string        `json:"markerValue" yaml:"markerValue"` // 标记值
+	MaxVersion  string        `json:"maxVersion" yaml:"maxVersion"`   // RuleTypeVersion: 最大版本，为空表示不限
+	MinVersion  string        `json:"minVersion" yaml:"minVersion"`   // RuleTypeVersion: 最小版本，为空表示不限
+	UserIds     []string      `json:"userIds" yaml:"userIds"`         // RuleTypeIdentify: 适用的用户ID列表
+	UserIdsKey  string        `json:"userIdsKey" yaml:"userIdsKey"`   // RuleTypeIdentify: 存放用户ID的 Redis SET key，刷新规则时用 SSCAN 加载
+	Canary      int           `json:"canary" yaml:"canary"`           // RuleTypeCanary: 流量百分比（0-100）
+	Path        string        `json:"path" yaml:"path"`               // RuleTypePath: URI路径匹配规则
+	PathMatch   PathMatch     `json:"pathMatch" yaml:"pathMatch"`     // RuleTypePath: 路径匹配模式 exact/prefix/glob/regex，默认 prefix
+	Conditions  *Condition    `json:"conditions" yaml:"conditions"`   // RuleTypeComposite: 组合条件树
+	Key         string        `json:"key" yaml:"key"`                 // RuleTypeHeader/Cookie/Query/Claim: header、cookie、query 参数名或 JWT claim 路径
+	Operator    MatchOperator `json:"operator" yaml:"operator"`       // RuleTypeHeader/Cookie/Query/Claim: 匹配操作 equals/in/regex/exists/absent，默认 equals
+	Values      []string      `json:"values" yaml:"values"`           // RuleTypeHeader/Cookie/Query/Claim: 匹配值，regex 时为正则表达式
+	CIDRs       []string      `json:"cidrs" yaml:"cidrs"`             // RuleTypeIP: 客户端IP网段列表，支持单个IP
+	Methods     []string      `json:"methods" yaml:"methods"`         // 可选，限定请求方法，如 GET、POST
+	Hosts       []string      `json:"hosts" yaml:"hosts"`             // 可选，限定请求 host，支持 *.example.com 通配子域名
+	StartAt     string        `json:"startAt" yaml:"startAt"`         // 可选，生效时间（RFC3339）
+	EndAt       string        `json:"endAt" yaml:"endAt"`             // 可选，失效时间（RFC3339）
+	Schedules   []Schedule    `json:"schedules" yaml:"schedules"`     // 可选，周期性生效时间窗口，命中任一窗口即生效
+
+	MinExclusive      bool              `json:"minExclusive" yaml:"minExclusive"`           // RuleTypeVersion: 最小版本不含边界
+	MaxExclusive      bool              `json:"maxExclusive" yaml:"maxExclusive"`           // RuleTypeVersion: 最大版本不含边界
+	VersionConstraint string            `json:"versionConstraint" yaml:"versionConstraint"` // RuleTypeVersion: 版本约束表达式，如 ">=2.0.0 <3.0.0 || 3.1.x"
+	PlatformVersions  []PlatformVersion `json:"platformVersions" yaml:"platformVersions"`   // RuleTypeVersion: 按平台区分的版本范围，未列出的平台使用上面的通用范围
+	Variants          []Variant         `json:"variants" yaml:"variants"`                   // RuleTypeSplit: 分流变体及权重，命中的变体值写入 markerKey
+	Salt              string            `json:"salt" yaml:"salt"`                           // RuleTypeSplit/Canary: 哈希盐，不同实验使用不同的盐以避免分组相关
+	CanaryBps         int               `json:"canaryBps" yaml:"canaryBps"`                 // RuleTypeCanary: 流量万分比（0-10000），大于0时覆盖 Canary
+	Buckets           []BucketRange     `json:"buckets" yaml:"buckets"`                     // RuleTypeCanary: 显式的桶区间（万分比），配置后覆盖 Canary/CanaryBps
+	UserIdsLookup     UserIdsLookup     `json:"userIdsLookup" yaml:"userIdsLookup"`         // RuleTypeIdentify: userIdsKey 的查询方式，load 刷新时加载到内存（默认），live 请求时 SISMEMBER 查询
+	FailOpen          bool              `json:"failOpen" yaml:"failOpen"`                   // RuleTypeIdentify: live 查询 Redis 失败或超时时视为命中，默认视为未命中
+
+	compiled *compiledRule // 加载规则时预编译的匹配器
+}
+
+// ruleDocument is a rule stored as JSON, either as the value of a string key or
+// in the json field of a rule hash. The rule fields use the json tags of Rule.
+type ruleDocument struct {
+	SchemaVersion int `json:"schemaVersion"` // 文档格式版本，当前为 1
+	Rule
+}
+
+// Condition is a node of a composite rule's condition tree. A node is either an
+// operator (all, any or not) or a leaf predicate that reuses the type-specific
+// fields of Rule, e.g. {"type": "path", "path": "/checkout"}.
+type Condition struct {
+	All  []Condition      `json:"all" yaml:"all"` // 所有子条件都满足
+	Any  []Condition      `json:"any" yaml:"any"` // 任一子条件满足
+	Not  *Condition       `json:"not" yaml:"not"` // 子条件不满足
+	Rule `yaml:",inline"` // 叶子条件，使用 Rule 的类型相关字段
+}
+
+// Schedule is a recurring activation window, e.g. weekdays from 09:00 to 18:00
+// in Asia/Shanghai. An endTime before startTime crosses midnight.
+type Schedule struct {
+	Days      []string `json:"days" yaml:"days"`           // 星期，如 mon、tue，为空表示每天
+	StartTime string   `json:"startTime" yaml:"startTime"` // 开始时间 HH:MM，为空表示全天
+	EndTime   string   `json:"endTime" yaml:"endTime"`     // 结束时间 HH:MM（不含）
+	Timezone  string   `json:"timezone" yaml:"timezone"`   // 时区，如 Asia/Shanghai，默认 UTC
+}
+
+// Variant is one arm of a split rule. Requests are assigned to variants in
+// proportion to their weights, e.g. control 50, a 25, b 25.
+type Variant struct {
+	Value  string `json:"value" yaml:"value"`   // 标记值
+	Weight int    `json:"weight" yaml:"weight"` // 权重
+}
+
+// BucketRange is a half-open range [From, To) of the 10000 hash buckets used by
+// canary rules. Listing ranges explicitly lets a canary grow while keeping its
+// original cohort, e.g. [0,500) then [0,500) + [5000,6500).
+type BucketRange struct {
+	From int `json:"from" yaml:"from"` // 起始桶（含）
+	To   int `json:"to" yaml:"to"`     // 结束桶（不含）
+}
+
+// PlatformVersion is the version range a version rule applies to clients of one
+// platform, e.g. iOS 3.4+ while Android needs 3.2+.
+type PlatformVersion struct {
+	Platform          string `json:"platform" yaml:"platform"`                   // 平台名，如 ios、android，不区分大小写
+	MinVersion        string `json:"minVersion" yaml:"minVersion"`               // 最小版本，为空表示不限
+	MaxVersion        string `json:"maxVersion" yaml:"maxVersion"`               // 最大版本，为空表示不限
+	MinExclusive      bool   `json:"minExclusive" yaml:"minExclusive"`           // 最小版本不含边界
+	MaxExclusive      bool   `json:"maxExclusive" yaml:"maxExclusive"`           // 最大版本不含边界
+	VersionConstraint string `json:"versionConstraint" yaml:"versionConstraint"` // 版本约束表达式
+}
+
+// PlatformPattern detects the client platform from a header, typically the
+// User-Agent, e.g. {platform: ios, pattern: "(?i)iOS|iPhone"}.
+type PlatformPattern struct {
+	Platform string `json:"platform"` // 命中时的平台名
+	Header   string `json:"header"`   // 匹配的 header，默认 User-Agent
+	Pattern  string `json:"pattern"`  // 正则表达式
 }
 
 type RedisConfig struct {
-	Enable          bool   `json:"enable"`          // 是否开启
-	Addr            string `json:"addr"`            // redis地址
-	Password        string `json:"password"`        // redis密码
-	DB              int    `json:"db"`              // redis数据库
-	RuleListKeys    string `json:"ruleListKeys"`    // 规则列表Key
-	RefreshInterval int64  `json:"refreshInterval"` // 刷新间隔，单位秒
+	Enable              bool   `json:"enable"`              // 是否开启
+	Addr                string `json:"addr"`                // redis地址
+	Password            string `json:"password"`            // redis密码
+	DB                  int    `json:"db"`                  // redis数据库
+	RuleListKeys        string `json:"ruleListKeys"`        // 规则列表Key
+	RefreshInterval     int64  `json:"refreshInterval"`     // 刷新间隔，单位秒
+	InvalidationChannel string `json:"invalidationChannel"` // 可选，订阅的失效通知频道，收到消息立即刷新规则，定时刷新作为兜底
+	ActiveVersionKey    string `json:"activeVersionKey"`    // 可选，保存当前生效规则集版本号的 key，配置后从 ruleListKeys:v{版本} 读取规则，切换版本即发布或回滚
+	LookupTimeout       int64  `json:"lookupTimeout"`       // live 查询单次超时，单位毫秒，默认 50
+	LookupCacheSize     int    `json:"lookupCacheSize"`     // live 查询结果的本地 LRU 缓存条数，默认 10000
+	LookupCacheTTL      int64  `json:"lookupCacheTTL"`      // live 查询结果的缓存时间，单位秒，默认 30
+}
+
+type FileConfig struct {
+	Enable          bool   `json:"enable"`          // 是否从文件加载规则，不能与 redisConfig、httpConfig 同时开启
+	Path            string `json:"path"`            // 规则文件路径，.json 按 JSON 解析，其它按 YAML 解析
+	RefreshInterval int64  `json:"refreshInterval"` // 检查文件变化的间隔，单位秒，默认 15
+}
+
+type HTTPConfig struct {
+	Enable          bool   `json:"enable"`          // 是否从 HTTP 规则服务拉取规则，不能与 redisConfig、fileConfig 同时开启
+	URL             string `json:"url"`             // 规则接口地址，如 http://experiments/rules，未指定 tag 参数时自动附加 tag
+	RefreshInterval int64  `json:"refreshInterval"` // 拉取间隔，单位秒，默认 15
+	Timeout         int64  `json:"timeout"`         // 单次请求超时，单位秒，默认 5
+	BearerToken     string `json:"bearerToken"`     // 可选，以 Authorization: Bearer 发送的令牌
+}
+
+type IdentifySource struct {
+	Type       IdentifySourceType `json:"type"`       // 身份来源 header/cookie/query/jwt/ip/path
+	Key        string             `json:"key"`        // header、cookie、query 参数名；jwt 时为 claim 路径，默认使用 jwt.claim
+	Pattern    string             `json:"pattern"`    // path 时匹配 URL 路径的正则，优先取名为 id 的分组，其次第一个分组
+	Lowercase  bool               `json:"lowercase"`  // 是否转为小写
+	TrimSpace  bool               `json:"trimSpace"`  // 是否去掉首尾空白
+	TrimPrefix string             `json:"trimPrefix"` // 去掉的前缀，如 Bearer 或 user-
+}
+
+type SnapshotPolicy struct {
+	Strict         bool   `json:"strict"`         // 任一规则读取或解析失败时拒绝整个快照，继续使用上一次成功加载的规则
+	MaxDropPercent int    `json:"maxDropPercent"` // 规则数比上一次快照减少超过该百分比时拒绝快照，0 表示不限制
+	StaleAfter     int64  `json:"staleAfter"`     // 距上次成功加载超过该秒数视为过期，默认 3 倍刷新间隔
+	Header         string `json:"header"`         // 可选，把当前规则快照的版本、来源、年龄和是否过期写入该请求头
+}
+
+type JWTConfig struct {
+	Enable    bool   `json:"enable"`    // 是否从 JWT 中提取用户身份和 claim
+	Header    string `json:"header"`    // 携带 token 的 header，默认 Authorization，会去掉 Bearer 前缀
+	Claim     string `json:"claim"`     // 用户身份所在的 claim 路径，默认 sub，嵌套 claim 用 . 分隔
+	Algorithm string `json:"algorithm"` // 签名校验算法 HS256/RS256，为空时只解码不校验
+	Secret    string `json:"secret"`    // HS256 密钥
+	PublicKey string `json:"publicKey"` // RS256 的 PEM 公钥或证书
+}
+
+type VisitorCookieConfig struct {
+	Enable   bool   `json:"enable"`   // 是否为匿名访客签发 visitor cookie
+	Name     string `json:"name"`     // cookie 名，默认 marker_vid
+	TTL      int64  `json:"ttl"`      // 有效期，单位秒，0 表示会话 cookie
+	Domain   string `json:"domain"`   // cookie 域名，为空时只对当前域名生效
+	Path     string `json:"path"`     // cookie 路径，默认 /
+	Secure   bool   `json:"secure"`   // 是否只在 https 下发送
+	SameSite string `json:"sameSite"` // lax/strict/none，为空时使用浏览器默认值；none 需要同时开启 secure
 }
 
 type Config struct {
-	Tag            string      `json:"tag"`            // tag，当rule.tag和config.tag匹配时候，才会使用这个规则
-	LogLevel       string      `json:"log_level"`      // 日志登记
-	RedisConfig    RedisConfig `json:"redis_config"`   // redis 配置，如果配置了。则使用动态配置
-	StaticRules    []Rule      `json:"static_rules"`   // 静态路由配置
-	MarkerKey      string      `json:"marker_key"`     // 标记 key
-	VersionHeader  string      `json:"versionHeader"`  // 版本号的header
-	IdentifyHeader string      `json:"identifyHeader"` // 用户身份的header
-	IdentifyCookie string      `json:"identifyCookie"` // 用户身份的cookie
-	IdentifyQuery  string      `json:"identifyQuery"`  // 用户身份的query参数
+	Tag                     string              `json:"tag"`                     // tag，当rule.tag和config.tag匹配时候，才会使用这个规则
+	LogLevel                string              `json:"log_level"`               // 日志登记
+	RedisConfig             RedisConfig         `json:"redis_config"`            // redis 配置，如果配置了。则使用动态配置
+	FileConfig              FileConfig          `json:"fileConfig"`              // 文件规则配置，适用于没有 Redis 的环境，如挂载的 ConfigMap
+	HTTPConfig              HTTPConfig          `json:"httpConfig"`              // HTTP 规则服务配置，从中心化的规则服务拉取规则
+	StaticRules             []Rule              `json:"static_rules"`            // 静态路由配置
+	SnapshotPolicy          SnapshotPolicy      `json:"snapshotPolicy"`          // 动态规则快照的接受策略，拒绝的快照不会替换当前规则
+	MarkerKey               string              `json:"marker_key"`              // 标记 key
+	VersionHeader           string              `json:"versionHeader"`           // 版本号的header
+	VersionPattern          string              `json:"versionPattern"`          // 可选，从 versionHeader 中提取版本号的正则，优先取名为 version 的分组，其次第一个分组
+	PlatformHeader          string              `json:"platformHeader"`          // 可选，直接携带平台名的 header，如 X-Platform
+	PlatformPatterns        []PlatformPattern   `json:"platformPatterns"`        // 可选，按顺序匹配 header 识别平台
+	IdentifyHeader          string              `json:"identifyHeader"`          // 用户身份的header，未配置 identifySources 时使用
+	IdentifyCookie          string              `json:"identifyCookie"`          // 用户身份的cookie，未配置 identifySources 时使用
+	IdentifyQuery           string              `json:"identifyQuery"`           // 用户身份的query参数，未配置 identifySources 时使用
+	JWT                     JWTConfig           `json:"jwt"`                     // JWT 解析配置，未配置 identifySources 时 claim 身份优先于 identifyHeader/Cookie/Query
+	IdentifySources         []IdentifySource    `json:"identifySources"`         // 按顺序尝试的用户身份来源，配置后取代 identifyHeader/Cookie/Query
+	IdentifyFallbacks       []IdentifyFallback  `json:"identifyFallbacks"`       // 匿名请求用于 canary/split 分桶的备选身份，按顺序尝试 ip/headers/random
+	IdentifyFallbackHeaders []string            `json:"identifyFallbackHeaders"` // headers 备选身份使用的 header 列表，如 User-Agent、Accept-Language
+	VisitorCookie           VisitorCookieConfig `json:"visitorCookie"`           // 匿名访客的粘性 cookie，优先于 identifyFallbacks
+	TrustedProxies          []string            `json:"trustedProxies"`          // 可信代理的IP或网段，只有来自可信代理的 X-Forwarded-For/X-Real-IP 才会被采用
 }
 
 func (r *Rule) Validate() error {
 	if r.Name == "" {
 		return fmt.Errorf("rule name cannot be empty")
 	}
-	if r.MarkerValue == "" {
+	// Split rules write the value of the selected variant instead
+	if r.MarkerValue == "" && r.Type != RuleTypeSplit {
 		return fmt.Errorf("rule mark_value cannot be empty")
 	}
+	if err := r.validateActivation(); err != nil {
+		return err
+	}
+	return r.validateMatch()
+}
+
+func (r *Rule) validateActivation() error {
+	var startAt, endAt time.Time
+	var err error
+	if r.StartAt != "" {
+		if startAt, err = parseTimestamp(r.StartAt); err != nil {
+			return fmt.Errorf("invalid startAt: %w", err)
+		}
+	}
+	if r.EndAt != "" {
+		if endAt, err = parseTimestamp(r.EndAt); err != nil {
+			return fmt.Errorf("invalid endAt: %w", err)
+		}
+	}
+	if !startAt.IsZero() && !endAt.IsZero() && !endAt.After(startAt) {
+		return fmt.Errorf("endAt must be after startAt")
+	}
+	for _, schedule := range r.Schedules {
+		if _, err := compileSchedule(schedule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateMatch checks the type-specific fields of the rule. It is shared by
+// top level rules and leaf conditions of composite rules.
+func (r *Rule) validateMatch() error {
+	for _, method := range r.Methods {
+		if strings.TrimSpace(method) == "" {
+			return fmt.Errorf("methods cannot contain empty values")
+		}
+	}
+	for _, host := range r.Hosts {
+		if err := validateHostPattern(host); err != nil {
+			return err
+		}
+	}
+
 	switch r.Type {
 	case RuleTypeVersion:
-		if r.MinVersion == "" || r.MaxVersion == "" {
-			return fmt.Errorf("version rule requires both minVersion and maxVersion")
+		hasRange := r.MinVersion != "" || r.MaxVersion != "" || r.VersionConstraint != ""
+		if !hasRange && len(r.PlatformVersions) == 0 {
+			return fmt.Errorf("version rule requires minVersion, maxVersion, versionConstraint or platformVersions")
+		}
+		if hasRange {
+			if _, err := compileVersionRange(r.MinVersion, r.MaxVersion, r.MinExclusive, r.MaxExclusive, r.VersionConstraint); err != nil {
+				return err
+			}
+		}
+		if _, err := compilePlatformVersions(r.PlatformVersions); err != nil {
+			return err
 		}
 	case RuleTypeIdentify:
-		if len(r.UserIds) == 0 {
-			return fmt.Errorf("identify rule requires at least one userIds")
+		if len(r.UserIds) == 0 && r.UserIdsKey == "" {
+			return fmt.Errorf("identify rule requires userIds or userIdsKey")
+		}
+		switch r.UserIdsLookup {
+		case "", UserIdsLookupLoad:
+		case UserIdsLookupLive:
+			if r.UserIdsKey == "" {
+				return fmt.Errorf("identify rule with live lookup requires userIdsKey")
+			}
+		default:
+			return fmt.Errorf("invalid userIdsLookup: %s", r.UserIdsLookup)
 		}
 	case RuleTypeCanary:
 		if r.Canary < 0 || r.Canary > 100 {
 			return fmt.Errorf("canary must be between 0 and 100, got %d", r.Canary)
 		}
+		if r.CanaryBps < 0 || r.CanaryBps > canaryBuckets {
+			return fmt.Errorf("canaryBps must be between 0 and %d, got %d", canaryBuckets, r.CanaryBps)
+		}
+		for _, bucket := range r.Buckets {
+			if bucket.From < 0 || bucket.To > canaryBuckets || bucket.From >= bucket.To {
+				return fmt.Errorf("invalid bucket range [%d,%d), expected 0 <= from < to <= %d", bucket.From, bucket.To, canaryBuckets)
+			}
+		}
 	case RuleTypePath:
 		if r.Path == "" {
 			return fmt.Errorf("path rule requires path")
 		}
+		if err := validatePathMatch(r.PathMatch, r.Path); err != nil {
+			return err
+		}
+	case RuleTypeHeader, RuleTypeCookie, RuleTypeQuery, RuleTypeClaim:
+		if r.Key == "" {
+			return fmt.Errorf("%s rule requires key", r.Type)
+		}
+		if err := validateOperator(r.Operator, r.Values); err != nil {
+			return fmt.Errorf("%s rule: %w", r.Type, err)
+		}
+	case RuleTypeIP:
+		if len(r.CIDRs) == 0 {
+			return fmt.Errorf("ip rule requires at least one cidrs")
+		}
+		for _, cidr := range r.CIDRs {
+			if _, err := parseCIDR(strings.TrimSpace(cidr)); err != nil {
+				return err
+			}
+		}
+	case RuleTypeSplit:
+		if len(r.Variants) == 0 {
+			return fmt.Errorf("split rule requires at least one variants")
+		}
+		total := 0
+		for _, variant := range r.Variants {
+			if variant.Value == "" {
+				return fmt.Errorf("split variant value cannot be empty")
+			}
+			if variant.Weight < 0 {
+				return fmt.Errorf("split variant %s weight cannot be negative, got %d", variant.Value, variant.Weight)
+			}
+			total += variant.Weight
+		}
+		if total <= 0 {
+			return fmt.Errorf("split rule requires a positive total weight")
+		}
+	case RuleTypeComposite:
+		if r.Conditions == nil {
+			return fmt.Errorf("composite rule requires conditions")
+		}
+		if err := r.Conditions.Validate(); err != nil {
+			return fmt.Errorf("invalid conditions: %w", err)
+		}
 	default:
 		return fmt.Errorf("unknown rule type: %s", r.Type)
 	}
 	return nil
 }
 
+func validateHostPattern(host string) error {
+	host = strings.TrimSpace(host)
+	if host == "" {
+		return fmt.Errorf("hosts cannot contain empty values")
+	}
+	if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return fmt.Errorf("invalid host pattern %q: only a leading *. wildcard is supported", host)
+	}
+	return nil
+}
+
+func validateOperator(op MatchOperator, values []string) error {
+	switch op {
+	case "", MatchOperatorEquals:
+		if len(values) != 1 {
+			return fmt.Errorf("operator equals requires exactly one value")
+		}
+	case MatchOperatorIn:
+		if len(values) == 0 {
+			return fmt.Errorf("operator in requires at least one value")
+		}
+	case MatchOperatorRegex:
+		if len(values) != 1 {
+			return fmt.Errorf("operator regex requires exactly one pattern")
+		}
+		if _, err := regexp.Compile(values[0]); err != nil {
+			return fmt.Errorf("invalid regex %q: %w", values[0], err)
+		}
+	case MatchOperatorExists, MatchOperatorAbsent:
+	default:
+		return fmt.Errorf("unknown operator: %s", op)
+	}
+	return nil
+}
+
+func (c *Condition) Validate() error {
+	operators := 0
+	if len(c.All) > 0 {
+		operators++
+	}
+	if len(c.Any) > 0 {
+		operators++
+	}
+	if c.Not != nil {
+		operators++
+	}
+	if operators > 1 || (operators == 1 && c.Type != "") {
+		return fmt.Errorf("condition must have exactly one of all, any, not or type")
+	}
+
+	switch {
+	case len(c.All) > 0:
+		return validateConditions(c.All)
+	case len(c.Any) > 0:
+		return validateConditions(c.Any)
+	case c.Not != nil:
+		return c.Not.Validate()
+	case c.Type == "":
+		return fmt.Errorf("condition must have exactly one of all, any, not or type")
+	case c.Type == RuleTypeComposite:
+		return fmt.Errorf("leaf condition cannot be composite, use all/any/not instead")
+	case c.Type == RuleTypeSplit:
+		return fmt.Errorf("leaf condition cannot be a split rule")
+	default:
+		if err := c.validateLeaf(); err != nil {
+			return err
+		}
+		return c.Rule.validateMatch()
+	}
+}
+
+// validateLeaf rejects the rule-level fields of Rule in a leaf condition, which
+// only evaluates the predicate and would silently ignore them.
+func (c *Condition) validateLeaf() error {
+	if c.Conditions != nil {
+		return fmt.Errorf("leaf condition cannot set conditions, nest all/any/not nodes instead")
+	}
+	var fields []string
+	if c.Tag != "" || len(c.Tags) > 0 {
+		fields = append(fields, "tag")
+	}
+	if c.Enable {
+		fields = append(fields, "enable")
+	}
+	if c.Priority != 0 {
+		fields = append(fields, "priority")
+	}
+	if c.MarkerValue != "" {
+		fields = append(fields, "markerValue")
+	}
+	if c.StartAt != "" || c.EndAt != "" || len(c.Schedules) > 0 {
+		fields = append(fields, "startAt/endAt/schedules")
+	}
+	if len(fields) > 0 {
+		return fmt.Errorf("leaf condition cannot set %s, set them on the composite rule", strings.Join(fields, ", "))
+	}
+	return nil
+}
+
+func validateConditions(conditions []Condition) error {
+	for i := range conditions {
+		if err := conditions[i].Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func parseRule(values []interface{}) (Rule, error) {
 	rule := Rule{}
+	var rawValues string
 	for i := 0; i < len(values); i += 2 {
 		fieldName, ok := values[i].([]byte)
 		if !ok {
@@ -103,6 +572,19 @@ func parseRule(values []interface{}) (Rule, error) {
 		fieldValue := values[i+1]
 
 		switch string(fieldName) {
+		case FieldJSON:
+			// A JSON document replaces the flat fields of the hash
+			val, err := redis.Bytes(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			return parseRuleJSON(val)
+		case FieldTag:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.Tag = val
 		case FieldName:
 			val, err := redis.String(fieldValue, nil)
 			if err != nil {
@@ -151,7 +633,7 @@ func parseRule(values []interface{}) (Rule, error) {
 				return rule, err
 			}
 			rule.UserIds = strings.Split(val, ",")
-		case FieldWeight:
+		case FieldWeight, FieldCanary:
 			val, err := redis.Int(fieldValue, nil)
 			if err != nil {
 				return rule, err
@@ -163,17 +645,235 @@ func parseRule(values []interface{}) (Rule, error) {
 				return rule, err
 			}
 			rule.Path = val
+		case FieldPathMatch:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.PathMatch = PathMatch(val)
+		case FieldConditions:
+			val, err := redis.Bytes(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			var conditions Condition
+			if err := json.Unmarshal(val, &conditions); err != nil {
+				return rule, fmt.Errorf("failed to decode conditions: %w", err)
+			}
+			rule.Conditions = &conditions
+		case FieldKey:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.Key = val
+		case FieldOperator:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.Operator = MatchOperator(val)
+		case FieldValues:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rawValues = val
+		case FieldCIDRs:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.CIDRs = strings.Split(val, ",")
+		case FieldMethods:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.Methods = strings.Split(val, ",")
+		case FieldHosts:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.Hosts = strings.Split(val, ",")
+		case FieldStartAt:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.StartAt = val
+		case FieldEndAt:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.EndAt = val
+		case FieldSchedules:
+			val, err := redis.Bytes(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			if err := json.Unmarshal(val, &rule.Schedules); err != nil {
+				return rule, fmt.Errorf("failed to decode schedules: %w", err)
+			}
+		case FieldMinExclusive:
+			val, err := redis.Bool(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.MinExclusive = val
+		case FieldMaxExclusive:
+			val, err := redis.Bool(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.MaxExclusive = val
+		case FieldVersionConstraint:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.VersionConstraint = val
+		case FieldPlatformVersions:
+			val, err := redis.Bytes(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			if err := json.Unmarshal(val, &rule.PlatformVersions); err != nil {
+				return rule, fmt.Errorf("failed to decode platform versions: %w", err)
+			}
+		case FieldVariants:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			variants, err := parseVariants(val)
+			if err != nil {
+				return rule, err
+			}
+			rule.Variants = variants
+		case FieldSalt:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.Salt = val
+		case FieldCanaryBps:
+			val, err := redis.Int(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.CanaryBps = val
+		case FieldBuckets:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			buckets, err := parseBuckets(val)
+			if err != nil {
+				return rule, err
+			}
+			rule.Buckets = buckets
+		case FieldUserIdsKey:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.UserIdsKey = val
+		case FieldUserIdsLookup:
+			val, err := redis.String(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.UserIdsLookup = UserIdsLookup(val)
+		case FieldFailOpen:
+			val, err := redis.Bool(fieldValue, nil)
+			if err != nil {
+				return rule, err
+			}
+			rule.FailOpen = val
 		}
 	}
 
-	// Validate rule after parsing
+	// Values are comma-separated, except for a regex which may contain commas itself
+	if rawValues != "" {
+		if rule.Operator == MatchOperatorRegex {
+			rule.Values = []string{rawValues}
+		} else {
+			rule.Values = strings.Split(rawValues, ",")
+		}
+	}
+
+	return prepareRule(rule)
+}
+
+// parseRuleJSON decodes a rule document. Unknown fields are rejected so that a
+// misspelled field fails loudly instead of leaving the rule half configured.
+func parseRuleJSON(data []byte) (Rule, error) {
+	var doc ruleDocument
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&doc); err != nil {
+		return Rule{}, fmt.Errorf("failed to decode rule document: %w", err)
+	}
+	if doc.SchemaVersion != ruleSchemaVersion {
+		return Rule{}, fmt.Errorf("unsupported rule schema version %d, expected %d", doc.SchemaVersion, ruleSchemaVersion)
+	}
+	return prepareRule(doc.Rule)
+}
+
+// prepareRule validates and compiles a rule loaded from Redis.
+func prepareRule(rule Rule) (Rule, error) {
 	if err := rule.Validate(); err != nil {
 		return rule, fmt.Errorf("invalid rule: %w", err)
 	}
-
+	if err := rule.compile(); err != nil {
+		return rule, fmt.Errorf("invalid rule: %w", err)
+	}
 	return rule, nil
 }
 
+// parseVariants parses the Redis representation of split variants, a
+// comma-separated list of value:weight pairs such as "control:50,a:25,b:25".
+func parseVariants(value string) ([]Variant, error) {
+	var variants []Variant
+	for _, item := range strings.Split(value, ",") {
+		i := strings.LastIndex(item, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid variant %q, expected value:weight", item)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(item[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight in variant %q: %w", item, err)
+		}
+		variants = append(variants, Variant{Value: strings.TrimSpace(item[:i]), Weight: weight})
+	}
+	return variants, nil
+}
+
+// parseBuckets parses the Redis representation of bucket ranges, a
+// comma-separated list of from-to pairs such as "0-500,5000-6500".
+func parseBuckets(value string) ([]BucketRange, error) {
+	var buckets []BucketRange
+	for _, item := range strings.Split(value, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(item), "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid bucket range %q, expected from-to", item)
+		}
+		from, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket range %q: %w", item, err)
+		}
+		to, err := strconv.Atoi(bounds[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket range %q: %w", item, err)
+		}
+		buckets = append(buckets, BucketRange{From: from, To: to})
+	}
+	return buckets, nil
+}
+
 type SortByPriority []Rule
 
 func (a SortByPriority) Len() int           { return len(a) }
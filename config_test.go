@@ -116,6 +116,318 @@ func TestParseRule_UserIdsParsing(t *testing.T) {
 	}
 }
 
+func TestParseRule_PathMatch(t *testing.T) {
+	values := []interface{}{
+		[]byte("name"), []byte("orders"),
+		[]byte("enable"), []byte("1"),
+		[]byte("priority"), []byte("10"),
+		[]byte("type"), []byte("path"),
+		[]byte("mark_value"), []byte("orders"),
+		[]byte("path"), []byte("^/api/v[0-9]+/orders$"),
+		[]byte("path_match"), []byte("regex"),
+	}
+
+	rule, err := parseRule(values)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if rule.PathMatch != PathMatchRegex {
+		t.Errorf("expected pathMatch=regex, got %s", rule.PathMatch)
+	}
+	if rule.compiled == nil || rule.compiled.pathRegexp == nil {
+		t.Errorf("expected path regex to be precompiled")
+	}
+}
+
+func TestParseRule_Conditions(t *testing.T) {
+	values := []interface{}{
+		[]byte("name"), []byte("beta-checkout"),
+		[]byte("enable"), []byte("1"),
+		[]byte("priority"), []byte("10"),
+		[]byte("type"), []byte("composite"),
+		[]byte("mark_value"), []byte("checkout-v3"),
+		[]byte("conditions"), []byte(`{"all":[{"type":"path","path":"/checkout"},{"not":{"type":"identify","userIds":["u1"]}}]}`),
+	}
+
+	rule, err := parseRule(values)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if rule.Conditions == nil || len(rule.Conditions.All) != 2 {
+		t.Fatalf("expected 2 conditions under all, got %+v", rule.Conditions)
+	}
+	if rule.Conditions.All[0].Path != "/checkout" {
+		t.Errorf("expected first condition path=/checkout, got %s", rule.Conditions.All[0].Path)
+	}
+	if rule.Conditions.All[1].Not == nil || rule.Conditions.All[1].Not.Type != RuleTypeIdentify {
+		t.Errorf("expected second condition to negate an identify predicate")
+	}
+}
+
+func TestParseRule_InvalidConditionsJSON(t *testing.T) {
+	values := []interface{}{
+		[]byte("name"), []byte("broken"),
+		[]byte("type"), []byte("composite"),
+		[]byte("mark_value"), []byte("x"),
+		[]byte("conditions"), []byte(`{"all":[`),
+	}
+
+	if _, err := parseRule(values); err == nil {
+		t.Errorf("expected error for malformed conditions JSON")
+	}
+}
+
+func TestParseRule_AttributeRule(t *testing.T) {
+	values := []interface{}{
+		[]byte("name"), []byte("eu-region"),
+		[]byte("enable"), []byte("1"),
+		[]byte("type"), []byte("header"),
+		[]byte("mark_value"), []byte("eu"),
+		[]byte("key"), []byte("X-Region"),
+		[]byte("values"), []byte("eu-west,eu-central"),
+		[]byte("operator"), []byte("in"),
+	}
+
+	rule, err := parseRule(values)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if rule.Key != "X-Region" || rule.Operator != MatchOperatorIn {
+		t.Errorf("expected key=X-Region operator=in, got key=%s operator=%s", rule.Key, rule.Operator)
+	}
+	if len(rule.Values) != 2 || rule.Values[1] != "eu-central" {
+		t.Errorf("expected values=[eu-west,eu-central], got %v", rule.Values)
+	}
+}
+
+func TestParseRule_AttributeRegexKeepsCommas(t *testing.T) {
+	values := []interface{}{
+		[]byte("name"), []byte("version-query"),
+		[]byte("type"), []byte("query"),
+		[]byte("mark_value"), []byte("x"),
+		[]byte("values"), []byte("^[0-9]{1,3}$"),
+		[]byte("key"), []byte("v"),
+		[]byte("operator"), []byte("regex"),
+	}
+
+	rule, err := parseRule(values)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(rule.Values) != 1 || rule.Values[0] != "^[0-9]{1,3}$" {
+		t.Errorf("expected regex to be kept as a single value, got %v", rule.Values)
+	}
+}
+
+func TestParseRule_MethodsAndHosts(t *testing.T) {
+	values := []interface{}{
+		[]byte("name"), []byte("orders"),
+		[]byte("type"), []byte("path"),
+		[]byte("mark_value"), []byte("write"),
+		[]byte("path"), []byte("/orders"),
+		[]byte("methods"), []byte("POST,PUT"),
+		[]byte("hosts"), []byte("api.eu.example.com,*.staging.example.com"),
+	}
+
+	rule, err := parseRule(values)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(rule.Methods) != 2 || rule.Methods[1] != "PUT" {
+		t.Errorf("expected methods=[POST,PUT], got %v", rule.Methods)
+	}
+	if len(rule.Hosts) != 2 || rule.Hosts[1] != "*.staging.example.com" {
+		t.Errorf("expected 2 hosts, got %v", rule.Hosts)
+	}
+}
+
+func TestParseRule_VersionConstraint(t *testing.T) {
+	values := []interface{}{
+		[]byte("name"), []byte("v2"),
+		[]byte("type"), []byte("version"),
+		[]byte("mark_value"), []byte("v2"),
+		[]byte("min_version"), []byte("2.0.0"),
+		[]byte("min_exclusive"), []byte("1"),
+		[]byte("version_constraint"), []byte(">=2.0.0 <3.0.0 || 3.1.x"),
+	}
+
+	rule, err := parseRule(values)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !rule.MinExclusive || rule.MaxExclusive {
+		t.Errorf("expected minExclusive=true maxExclusive=false, got %v %v", rule.MinExclusive, rule.MaxExclusive)
+	}
+	if rule.VersionConstraint != ">=2.0.0 <3.0.0 || 3.1.x" {
+		t.Errorf("unexpected versionConstraint %q", rule.VersionConstraint)
+	}
+}
+
+func TestParseRule_SplitRule(t *testing.T) {
+	values := []interface{}{
+		[]byte("name"), []byte("abc"),
+		[]byte("type"), []byte("split"),
+		[]byte("salt"), []byte("abc-2024"),
+		[]byte("variants"), []byte("control:50, a:25,b:25"),
+	}
+
+	rule, err := parseRule(values)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if rule.Salt != "abc-2024" {
+		t.Errorf("expected salt=abc-2024, got %s", rule.Salt)
+	}
+	if len(rule.Variants) != 3 || rule.Variants[1] != (Variant{Value: "a", Weight: 25}) {
+		t.Errorf("unexpected variants %+v", rule.Variants)
+	}
+
+	values[len(values)-1] = []byte("control=50")
+	if _, err := parseRule(values); err == nil {
+		t.Errorf("expected error for malformed variants")
+	}
+}
+
+func TestParseRule_CanaryBuckets(t *testing.T) {
+	values := []interface{}{
+		[]byte("name"), []byte("canary"),
+		[]byte("type"), []byte("canary"),
+		[]byte("mark_value"), []byte("canary"),
+		[]byte("salt"), []byte("checkout"),
+		[]byte("canary_bps"), []byte("250"),
+		[]byte("buckets"), []byte("0-500, 5000-6500"),
+	}
+
+	rule, err := parseRule(values)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if rule.CanaryBps != 250 || rule.Salt != "checkout" {
+		t.Errorf("expected canaryBps=250 salt=checkout, got %d %s", rule.CanaryBps, rule.Salt)
+	}
+	if len(rule.Buckets) != 2 || rule.Buckets[1] != (BucketRange{From: 5000, To: 6500}) {
+		t.Errorf("unexpected buckets %+v", rule.Buckets)
+	}
+}
+
+func TestParseRule_Tags(t *testing.T) {
+	values := []interface{}{
+		[]byte("tag"), []byte("api, web"),
+		[]byte("name"), []byte("shared"),
+		[]byte("type"), []byte("path"),
+		[]byte("mark_value"), []byte("shared"),
+		[]byte("path"), []byte("/"),
+	}
+
+	rule, err := parseRule(values)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if rule.Tag != "api, web" {
+		t.Errorf("expected tag 'api, web', got %s", rule.Tag)
+	}
+	for _, tag := range []string{"api", "web"} {
+		if !rule.hasTag(tag) {
+			t.Errorf("expected rule to serve tag %s", tag)
+		}
+	}
+	if rule.hasTag("") || rule.hasTag("admin") {
+		t.Errorf("expected rule not to serve other tags")
+	}
+}
+
+func TestParseRule_CanaryField(t *testing.T) {
+	for _, field := range []string{"canary", "weight"} {
+		values := []interface{}{
+			[]byte("name"), []byte("canary"),
+			[]byte("type"), []byte("canary"),
+			[]byte("mark_value"), []byte("canary"),
+			[]byte(field), []byte("30"),
+		}
+
+		rule, err := parseRule(values)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", field, err)
+		}
+		if rule.Canary != 30 {
+			t.Errorf("%s: expected canary 30, got %d", field, rule.Canary)
+		}
+	}
+}
+
+func TestParseRuleJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr bool
+	}{
+		{"valid", `{"schemaVersion":1,"name":"beta","type":"identify","markerValue":"beta","userIds":["u1","a,b"]}`, false},
+		{"nested conditions", `{"schemaVersion":1,"name":"eu","type":"composite","markerValue":"eu","conditions":{"all":[{"type":"path","path":"/api"},{"type":"header","key":"X-Region","values":["eu"]}]}}`, false},
+		{"missing schema version", `{"name":"beta","type":"identify","markerValue":"beta","userIds":["u1"]}`, true},
+		{"newer schema version", `{"schemaVersion":2,"name":"beta","type":"identify","markerValue":"beta","userIds":["u1"]}`, true},
+		{"unknown field", `{"schemaVersion":1,"name":"canary","type":"canary","markerValue":"canary","weight":30}`, true},
+		{"invalid rule", `{"schemaVersion":1,"name":"beta","type":"identify","markerValue":"beta"}`, true},
+		{"malformed", `{"schemaVersion":1,`, true},
+	}
+
+	for _, tt := range tests {
+		_, err := parseRuleJSON([]byte(tt.doc))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
+
+func TestParseRule_JSONField(t *testing.T) {
+	values := []interface{}{
+		[]byte("name"), []byte("ignored"),
+		[]byte("json"), []byte(`{"schemaVersion":1,"name":"beta","type":"identify","markerValue":"beta","userIds":["u1","a,b"]}`),
+	}
+
+	rule, err := parseRule(values)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rule.Name != "beta" || len(rule.UserIds) != 2 || rule.UserIds[1] != "a,b" {
+		t.Errorf("expected the json document to be decoded, got %+v", rule)
+	}
+	if rule.compiled == nil {
+		t.Errorf("expected the rule to be compiled")
+	}
+}
+
+func TestRuleHasTag(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     Rule
+		tag      string
+		expected bool
+	}{
+		{"single", Rule{Tag: "api"}, "api", true},
+		{"single mismatch", Rule{Tag: "api"}, "web", false},
+		{"untagged rule serves untagged middleware", Rule{}, "", true},
+		{"untagged rule skips tagged middleware", Rule{}, "api", false},
+		{"tags list", Rule{Tags: []string{"api", "web"}}, "web", true},
+		{"tag and tags merged", Rule{Tag: "api", Tags: []string{"web"}}, "api", true},
+		{"tagged rule skips untagged middleware", Rule{Tags: []string{"api"}}, "", false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.rule.hasTag(tt.tag); got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
 func TestSortByPriority(t *testing.T) {
 	rules := []Rule{
 		{Name: "low", Priority: 10},
@@ -154,7 +466,7 @@ func TestRuleValidate_ValidVersionRule(t *testing.T) {
 	}
 }
 
-func TestRuleValidate_VersionRuleMissingMinVersion(t *testing.T) {
+func TestRuleValidate_VersionRuleOnlyMaxVersion(t *testing.T) {
 	rule := Rule{
 		Name:        "version-rule",
 		MarkerValue: "v2",
@@ -163,12 +475,12 @@ func TestRuleValidate_VersionRuleMissingMinVersion(t *testing.T) {
 	}
 
 	err := rule.Validate()
-	if err == nil {
-		t.Errorf("expected error for version rule missing minVersion")
+	if err != nil {
+		t.Errorf("expected no error for open-ended version rule, got %v", err)
 	}
 }
 
-func TestRuleValidate_VersionRuleMissingMaxVersion(t *testing.T) {
+func TestRuleValidate_VersionRuleOnlyMinVersion(t *testing.T) {
 	rule := Rule{
 		Name:        "version-rule",
 		MarkerValue: "v2",
@@ -176,9 +488,66 @@ func TestRuleValidate_VersionRuleMissingMaxVersion(t *testing.T) {
 		MinVersion:  "1.0.0",
 	}
 
+	err := rule.Validate()
+	if err != nil {
+		t.Errorf("expected no error for open-ended version rule, got %v", err)
+	}
+}
+
+func TestRuleValidate_VersionRuleNoBounds(t *testing.T) {
+	rule := Rule{
+		Name:        "version-rule",
+		MarkerValue: "v2",
+		Type:        RuleTypeVersion,
+	}
+
 	err := rule.Validate()
 	if err == nil {
-		t.Errorf("expected error for version rule missing maxVersion")
+		t.Errorf("expected error for version rule without bounds or constraint")
+	}
+}
+
+func TestRuleValidate_VersionRulePlatformVersions(t *testing.T) {
+	rule := Rule{
+		Name:        "version-rule",
+		MarkerValue: "v2",
+		Type:        RuleTypeVersion,
+		PlatformVersions: []PlatformVersion{
+			{Platform: "ios", MinVersion: "3.4.0"},
+			{Platform: "android", VersionConstraint: ">=3.2.0"},
+		},
+	}
+	if err := rule.Validate(); err != nil {
+		t.Errorf("expected no error for platform-only version rule, got %v", err)
+	}
+
+	rule.PlatformVersions = append(rule.PlatformVersions, PlatformVersion{Platform: "IOS", MinVersion: "1.0.0"})
+	if err := rule.Validate(); err == nil {
+		t.Errorf("expected error for duplicate platform")
+	}
+
+	rule.PlatformVersions = []PlatformVersion{{Platform: "ios"}}
+	if err := rule.Validate(); err == nil {
+		t.Errorf("expected error for platform version without range")
+	}
+}
+
+func TestRuleValidate_VersionRuleInvalid(t *testing.T) {
+	tests := []Rule{
+		{MinVersion: "garbage"},
+		{MaxVersion: "2.x.1"},
+		{MinVersion: "3.0.0", MaxVersion: "2.0.0"},
+		{VersionConstraint: ">=2.0.0 <"},
+		{VersionConstraint: ">=2.0.0 ||"},
+	}
+
+	for _, rule := range tests {
+		rule.Name = "version-rule"
+		rule.MarkerValue = "v2"
+		rule.Type = RuleTypeVersion
+		if err := rule.Validate(); err == nil {
+			t.Errorf("expected error for version rule %+v", rule)
+		}
 	}
 }
 
@@ -210,6 +579,46 @@ func TestRuleValidate_IdentifyRuleNoUserIds(t *testing.T) {
 	}
 }
 
+func TestRuleValidate_IdentifyRuleUserIdsKey(t *testing.T) {
+	rule := Rule{
+		Name:        "identify-rule",
+		MarkerValue: "beta",
+		Type:        RuleTypeIdentify,
+		UserIdsKey:  "marker:api:beta-users",
+	}
+
+	err := rule.Validate()
+	if err != nil {
+		t.Errorf("expected no error for identify rule with userIdsKey, got %v", err)
+	}
+}
+
+func TestRuleValidate_IdentifyRuleLookup(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Rule
+		valid bool
+	}{
+		{"live", Rule{UserIdsKey: "whitelist", UserIdsLookup: UserIdsLookupLive, FailOpen: true}, true},
+		{"load", Rule{UserIdsKey: "whitelist", UserIdsLookup: UserIdsLookupLoad}, true},
+		{"live without key", Rule{UserIds: []string{"u1"}, UserIdsLookup: UserIdsLookupLive}, false},
+		{"unknown lookup", Rule{UserIdsKey: "whitelist", UserIdsLookup: "stream"}, false},
+	}
+
+	for _, tt := range tests {
+		tt.rule.Name = "identify-rule"
+		tt.rule.MarkerValue = "beta"
+		tt.rule.Type = RuleTypeIdentify
+		err := tt.rule.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected no error, got %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
 func TestRuleValidate_ValidCanaryRule(t *testing.T) {
 	rule := Rule{
 		Name:        "canary-rule",
@@ -279,6 +688,178 @@ func TestRuleValidate_PathRuleNoPath(t *testing.T) {
 	}
 }
 
+func TestRuleValidate_PathRuleInvalidRegex(t *testing.T) {
+	rule := Rule{
+		Name:        "path-rule",
+		MarkerValue: "admin",
+		Type:        RuleTypePath,
+		Path:        "/users/(",
+		PathMatch:   PathMatchRegex,
+	}
+
+	err := rule.Validate()
+	if err == nil {
+		t.Errorf("expected error for path rule with invalid regex")
+	}
+}
+
+func TestRuleValidate_PathRuleUnknownMatchMode(t *testing.T) {
+	rule := Rule{
+		Name:        "path-rule",
+		MarkerValue: "admin",
+		Type:        RuleTypePath,
+		Path:        "/admin",
+		PathMatch:   PathMatch("contains"),
+	}
+
+	err := rule.Validate()
+	if err == nil {
+		t.Errorf("expected error for path rule with unknown match mode")
+	}
+}
+
+func TestRuleValidate_CompositeRule(t *testing.T) {
+	tests := []struct {
+		name       string
+		conditions *Condition
+		valid      bool
+	}{
+		{"missing conditions", nil, false},
+		{"valid tree", &Condition{Any: []Condition{
+			{Rule: Rule{Type: RuleTypePath, Path: "/a"}},
+			{Not: &Condition{Rule: Rule{Type: RuleTypeCanary, Canary: 10}}},
+		}}, true},
+		{"empty node", &Condition{}, false},
+		{"operator and type", &Condition{Rule: Rule{Type: RuleTypePath, Path: "/a"}, Not: &Condition{Rule: Rule{Type: RuleTypePath, Path: "/b"}}}, false},
+		{"invalid leaf", &Condition{All: []Condition{{Rule: Rule{Type: RuleTypePath}}}}, false},
+		{"nested composite leaf", &Condition{Rule: Rule{Type: RuleTypeComposite}}, false},
+		{"leaf with schedule", &Condition{Rule: Rule{Type: RuleTypePath, Path: "/a", Schedules: []Schedule{{Days: []string{"mon"}}}}}, false},
+		{"leaf with end time", &Condition{Not: &Condition{Rule: Rule{Type: RuleTypePath, Path: "/a", EndAt: "2030-01-01T00:00:00Z"}}}, false},
+		{"leaf with enable", &Condition{Rule: Rule{Type: RuleTypePath, Path: "/a", Enable: true}}, false},
+		{"leaf with tag", &Condition{Rule: Rule{Type: RuleTypePath, Path: "/a", Tag: "api"}}, false},
+		{"leaf with marker value", &Condition{Rule: Rule{Type: RuleTypePath, Path: "/a", MarkerValue: "a"}}, false},
+		{"leaf with conditions", &Condition{Rule: Rule{Type: RuleTypePath, Path: "/a", Conditions: &Condition{Rule: Rule{Type: RuleTypePath, Path: "/b"}}}}, false},
+	}
+
+	for _, tt := range tests {
+		rule := Rule{
+			Name:        "composite-rule",
+			MarkerValue: "mark",
+			Type:        RuleTypeComposite,
+			Conditions:  tt.conditions,
+		}
+		err := rule.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected no error, got %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestRuleValidate_AttributeRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Rule
+		valid bool
+	}{
+		{"header equals", Rule{Type: RuleTypeHeader, Key: "X-Platform", Values: []string{"ios"}}, true},
+		{"cookie exists", Rule{Type: RuleTypeCookie, Key: "session", Operator: MatchOperatorExists}, true},
+		{"query in", Rule{Type: RuleTypeQuery, Key: "debug", Operator: MatchOperatorIn, Values: []string{"1", "true"}}, true},
+		{"claim regex", Rule{Type: RuleTypeClaim, Key: "org.id", Operator: MatchOperatorRegex, Values: []string{"^42"}}, true},
+		{"claim missing key", Rule{Type: RuleTypeClaim, Values: []string{"gold"}}, false},
+		{"missing key", Rule{Type: RuleTypeHeader, Values: []string{"ios"}}, false},
+		{"equals without value", Rule{Type: RuleTypeHeader, Key: "X-Platform"}, false},
+		{"in without values", Rule{Type: RuleTypeQuery, Key: "debug", Operator: MatchOperatorIn}, false},
+		{"invalid regex", Rule{Type: RuleTypeHeader, Key: "X-Region", Operator: MatchOperatorRegex, Values: []string{"("}}, false},
+		{"unknown operator", Rule{Type: RuleTypeHeader, Key: "X-Region", Operator: "like", Values: []string{"eu"}}, false},
+	}
+
+	for _, tt := range tests {
+		tt.rule.Name = "attribute-rule"
+		tt.rule.MarkerValue = "mark"
+		err := tt.rule.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected no error, got %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestRuleValidate_IPRule(t *testing.T) {
+	rule := Rule{
+		Name:        "office",
+		MarkerValue: "office",
+		Type:        RuleTypeIP,
+		CIDRs:       []string{"10.0.0.0/8", "192.168.1.10"},
+	}
+	if err := rule.Validate(); err != nil {
+		t.Errorf("expected no error for valid ip rule, got %v", err)
+	}
+
+	rule.CIDRs = []string{"10.0.0.0/99"}
+	if err := rule.Validate(); err == nil {
+		t.Errorf("expected error for ip rule with invalid cidr")
+	}
+
+	rule.CIDRs = nil
+	if err := rule.Validate(); err == nil {
+		t.Errorf("expected error for ip rule without cidrs")
+	}
+}
+
+func TestRuleValidate_MethodsAndHosts(t *testing.T) {
+	rule := Rule{
+		Name:        "orders",
+		MarkerValue: "write",
+		Type:        RuleTypePath,
+		Path:        "/orders",
+		Methods:     []string{"POST"},
+		Hosts:       []string{"*.example.com"},
+	}
+	if err := rule.Validate(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	rule.Hosts = []string{"api.*.example.com"}
+	if err := rule.Validate(); err == nil {
+		t.Errorf("expected error for host with inner wildcard")
+	}
+
+	rule.Hosts = nil
+	rule.Methods = []string{""}
+	if err := rule.Validate(); err == nil {
+		t.Errorf("expected error for empty method")
+	}
+}
+
+func TestRuleValidate_SplitRule(t *testing.T) {
+	rule := Rule{
+		Name:     "split",
+		Type:     RuleTypeSplit,
+		Variants: []Variant{{Value: "control", Weight: 50}, {Value: "a", Weight: 50}},
+	}
+	if err := rule.Validate(); err != nil {
+		t.Errorf("expected no error for split rule without markValue, got %v", err)
+	}
+
+	invalid := [][]Variant{
+		nil,
+		{{Value: "control", Weight: 0}},
+		{{Value: "", Weight: 10}},
+		{{Value: "a", Weight: -1}, {Value: "b", Weight: 10}},
+	}
+	for _, variants := range invalid {
+		rule.Variants = variants
+		if err := rule.Validate(); err == nil {
+			t.Errorf("expected error for variants %+v", variants)
+		}
+	}
+}
+
 func TestRuleValidate_EmptyName(t *testing.T) {
 	rule := Rule{
 		MarkerValue: "mark",
@@ -346,6 +927,33 @@ func TestRuleValidate_CanaryBoundary_Hundred(t *testing.T) {
 	}
 }
 
+func TestRuleValidate_CanaryBpsAndBuckets(t *testing.T) {
+	tests := []struct {
+		rule  Rule
+		valid bool
+	}{
+		{Rule{CanaryBps: 10000}, true},
+		{Rule{CanaryBps: 10001}, false},
+		{Rule{CanaryBps: -1}, false},
+		{Rule{Buckets: []BucketRange{{From: 0, To: 500}, {From: 9000, To: 10000}}}, true},
+		{Rule{Buckets: []BucketRange{{From: 500, To: 500}}}, false},
+		{Rule{Buckets: []BucketRange{{From: 0, To: 10001}}}, false},
+	}
+
+	for _, tt := range tests {
+		tt.rule.Name = "canary-rule"
+		tt.rule.MarkerValue = "canary"
+		tt.rule.Type = RuleTypeCanary
+		err := tt.rule.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("%+v: expected no error, got %v", tt.rule, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%+v: expected error", tt.rule)
+		}
+	}
+}
+
 func TestRuleTypes(t *testing.T) {
 	tests := []struct {
 		ruleType RuleType
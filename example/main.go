@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -12,38 +13,81 @@ import (
 )
 
 type Rule struct {
-	Tag         string   `yaml:"tag"`
-	Name        string   `yaml:"name"`
-	Enable      bool     `yaml:"enable"`
-	Priority    int      `yaml:"priority"`
-	Type        string   `yaml:"type"`
-	MarkerValue string   `yaml:"markValue"`
-	MinVersion  string   `yaml:"minVersion"`
-	MaxVersion  string   `yaml:"maxVersion"`
-	UserIds     []string `yaml:"userIds"`
-	Canary      int      `yaml:"canary"`
-	Path        string   `yaml:"path"`
+	Tag               string                   `yaml:"tag" json:"tag,omitempty"`
+	Tags              []string                 `yaml:"tags" json:"tags,omitempty"`
+	Name              string                   `yaml:"name" json:"name,omitempty"`
+	Enable            bool                     `yaml:"enable" json:"enable,omitempty"`
+	Priority          int                      `yaml:"priority" json:"priority,omitempty"`
+	Type              string                   `yaml:"type" json:"type,omitempty"`
+	MarkerValue       string                   `yaml:"markValue" json:"markerValue,omitempty"`
+	MinVersion        string                   `yaml:"minVersion" json:"minVersion,omitempty"`
+	MaxVersion        string                   `yaml:"maxVersion" json:"maxVersion,omitempty"`
+	UserIds           []string                 `yaml:"userIds" json:"userIds,omitempty"`
+	UserIdsKey        string                   `yaml:"userIdsKey" json:"userIdsKey,omitempty"`
+	UserIdsLookup     string                   `yaml:"userIdsLookup" json:"userIdsLookup,omitempty"`
+	FailOpen          bool                     `yaml:"failOpen" json:"failOpen,omitempty"`
+	Canary            int                      `yaml:"canary" json:"canary,omitempty"`
+	Path              string                   `yaml:"path" json:"path,omitempty"`
+	PathMatch         string                   `yaml:"pathMatch" json:"pathMatch,omitempty"`
+	Conditions        map[string]interface{}   `yaml:"conditions" json:"conditions,omitempty"`
+	Key               string                   `yaml:"key" json:"key,omitempty"`
+	Operator          string                   `yaml:"operator" json:"operator,omitempty"`
+	Values            []string                 `yaml:"values" json:"values,omitempty"`
+	CIDRs             []string                 `yaml:"cidrs" json:"cidrs,omitempty"`
+	Methods           []string                 `yaml:"methods" json:"methods,omitempty"`
+	Hosts             []string                 `yaml:"hosts" json:"hosts,omitempty"`
+	StartAt           string                   `yaml:"startAt" json:"startAt,omitempty"`
+	EndAt             string                   `yaml:"endAt" json:"endAt,omitempty"`
+	Schedules         []map[string]interface{} `yaml:"schedules" json:"schedules,omitempty"`
+	MinExclusive      bool                     `yaml:"minExclusive" json:"minExclusive,omitempty"`
+	MaxExclusive      bool                     `yaml:"maxExclusive" json:"maxExclusive,omitempty"`
+	VersionConstraint string                   `yaml:"versionConstraint" json:"versionConstraint,omitempty"`
+	PlatformVersions  []map[string]interface{} `yaml:"platformVersions" json:"platformVersions,omitempty"`
+	Variants          []Variant                `yaml:"variants" json:"variants,omitempty"`
+	Salt              string                   `yaml:"salt" json:"salt,omitempty"`
+	CanaryBps         int                      `yaml:"canaryBps" json:"canaryBps,omitempty"`
+	Buckets           []Bucket                 `yaml:"buckets" json:"buckets,omitempty"`
+}
+
+// ruleSchemaVersion is the JSON rule document version understood by the plugin
+const ruleSchemaVersion = 1
+
+type RuleDocument struct {
+	SchemaVersion int `json:"schemaVersion"`
+	Rule
+}
+
+type Bucket struct {
+	From int `yaml:"from" json:"from,omitempty"`
+	To   int `yaml:"to" json:"to,omitempty"`
+}
+
+type Variant struct {
+	Value  string `yaml:"value" json:"value,omitempty"`
+	Weight int    `yaml:"weight" json:"weight,omitempty"`
 }
 
 type RedisConfig struct {
-	Enable          bool   `yaml:"enable"`
-	Addr            string `yaml:"addr"`
-	Password        string `yaml:"password"`
-	DB              int    `yaml:"db"`
-	RuleListKeys    string `yaml:"ruleListKeys"`
-	RefreshInterval int64  `yaml:"refreshInterval"`
+	Enable              bool   `yaml:"enable"`
+	Addr                string `yaml:"addr"`
+	Password            string `yaml:"password"`
+	DB                  int    `yaml:"db"`
+	RuleListKeys        string `yaml:"ruleListKeys"`
+	RefreshInterval     int64  `yaml:"refreshInterval"`
+	InvalidationChannel string `yaml:"invalidationChannel"`
+	ActiveVersionKey    string `yaml:"activeVersionKey"`
 }
 
 type Config struct {
-	Tag         string      `yaml:"tag"`
-	LogLevel    string      `yaml:"logLevel"`
-	MarkerKey   string      `yaml:"markerKey"`
-	VersionHeader string    `yaml:"versionHeader"`
-	IdentifyHeader string   `yaml:"identifyHeader"`
-	IdentifyCookie string   `yaml:"identifyCookie"`
-	IdentifyQuery string    `yaml:"identifyQuery"`
-	RedisConfig RedisConfig `yaml:"redisConfig"`
-	StaticRules []Rule      `yaml:"staticRules"`
+	Tag            string      `yaml:"tag"`
+	LogLevel       string      `yaml:"logLevel"`
+	MarkerKey      string      `yaml:"markerKey"`
+	VersionHeader  string      `yaml:"versionHeader"`
+	IdentifyHeader string      `yaml:"identifyHeader"`
+	IdentifyCookie string      `yaml:"identifyCookie"`
+	IdentifyQuery  string      `yaml:"identifyQuery"`
+	RedisConfig    RedisConfig `yaml:"redisConfig"`
+	StaticRules    []Rule      `yaml:"staticRules"`
 }
 
 func main() {
@@ -51,6 +95,9 @@ func main() {
 	redisAddr := flag.String("redis", "localhost:6379", "Redis address")
 	redisPassword := flag.String("password", "", "Redis password")
 	redisDB := flag.Int("db", 0, "Redis database")
+	format := flag.String("format", "hash", "Rule storage format: hash or json")
+	versionFlag := flag.String("version", "", "Version to publish the rules as, defaults to the next free version")
+	activate := flag.Bool("activate", false, "Activate the published version right away")
 	flag.Parse()
 
 	// Read config file
@@ -96,51 +143,81 @@ func main() {
 		}
 	}
 
-	// Clear existing rules
+	switch command := flag.Arg(0); command {
+	case "", "load":
+	case "list":
+		listVersions(conn, config.RedisConfig)
+		return
+	case "diff":
+		diffVersions(conn, config.RedisConfig, flag.Arg(1), flag.Arg(2))
+		return
+	case "activate":
+		activateVersion(conn, config.RedisConfig, flag.Arg(1))
+		return
+	default:
+		log.Fatalf("Unknown command %q, expected load, list, diff or activate", command)
+	}
+
+	if *format != "hash" && *format != "json" {
+		log.Fatalf("Unknown format %q, expected hash or json", *format)
+	}
+
 	ruleListKey := config.RedisConfig.RuleListKeys
+	version := ""
+	if config.RedisConfig.ActiveVersionKey != "" {
+		// Versions are immutable, publish into a new one
+		version = newVersion(conn, config.RedisConfig, *versionFlag)
+		ruleListKey = versionedKey(ruleListKey, version)
+	}
+
+	// Write the whole rule set in one transaction, so that the middleware
+	// never reads an empty or half written rule list
+	if _, err := conn.Do("MULTI"); err != nil {
+		log.Fatalf("Failed to start transaction: %v", err)
+	}
+
+	// Clear existing rules
 	if _, err := conn.Do("DEL", ruleListKey); err != nil {
 		log.Fatalf("Failed to clear rule list: %v", err)
 	}
 
 	// Load rules
 	for _, rule := range config.StaticRules {
-		ruleKey := fmt.Sprintf("%s:rule:%s", strings.TrimSuffix(ruleListKey, ":rules"), rule.Name)
-
-		// Build hash fields
-		fields := []interface{}{
-			"name", rule.Name,
-			"enable", boolToInt(rule.Enable),
-			"priority", rule.Priority,
-			"type", rule.Type,
-			"mark_value", rule.MarkerValue,
-		}
+		ruleKey := versionedKey(fmt.Sprintf("%s:rule:%s", strings.TrimSuffix(config.RedisConfig.RuleListKeys, ":rules"), rule.Name), version)
 
-		if rule.MinVersion != "" {
-			fields = append(fields, "min_version", rule.MinVersion)
-		}
-		if rule.MaxVersion != "" {
-			fields = append(fields, "max_version", rule.MaxVersion)
-		}
-		if len(rule.UserIds) > 0 {
-			fields = append(fields, "user_ids", strings.Join(rule.UserIds, ","))
-		}
-		if rule.Canary > 0 {
-			fields = append(fields, "canary", rule.Canary)
-		}
-		if rule.Path != "" {
-			fields = append(fields, "path", rule.Path)
+		// Drop the previous rule, it may have been stored in the other format
+		if _, err := conn.Do("DEL", ruleKey); err != nil {
+			log.Fatalf("Failed to clear rule %s: %v", ruleKey, err)
 		}
 
-		// Store rule hash
-		if _, err := conn.Do("HSET", append([]interface{}{ruleKey}, fields...)...); err != nil {
-			log.Fatalf("Failed to set rule %s: %v", ruleKey, err)
+		if *format == "json" {
+			document, err := json.Marshal(RuleDocument{SchemaVersion: ruleSchemaVersion, Rule: rule})
+			if err != nil {
+				log.Fatalf("Failed to encode rule %s: %v", rule.Name, err)
+			}
+			if _, err := conn.Do("SET", ruleKey, document); err != nil {
+				log.Fatalf("Failed to set rule %s: %v", ruleKey, err)
+			}
+		} else {
+			storeHash(conn, ruleKey, rule)
 		}
 
 		// Add to rule list
 		if _, err := conn.Do("RPUSH", ruleListKey, ruleKey); err != nil {
 			log.Fatalf("Failed to add rule to list %s: %v", ruleKey, err)
 		}
+	}
 
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		log.Fatalf("Failed to write rules: %v", err)
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redis.Error); ok {
+			log.Fatalf("Failed to write rules: %v", err)
+		}
+	}
+	for _, rule := range config.StaticRules {
 		fmt.Printf("✓ Loaded rule: %s\n", rule.Name)
 	}
 
@@ -148,6 +225,149 @@ func main() {
 	fmt.Printf("  Rule list key: %s\n", ruleListKey)
 	fmt.Printf("  Redis address: %s\n", config.RedisConfig.Addr)
 	fmt.Printf("  Redis database: %d\n", config.RedisConfig.DB)
+
+	if version == "" {
+		publishInvalidation(conn, config.RedisConfig)
+	} else if *activate {
+		activateVersion(conn, config.RedisConfig, version)
+	} else {
+		fmt.Printf("\n  Activate with: load-config -config %s activate %s\n", *configFile, version)
+	}
+}
+
+// publishInvalidation tells running middlewares to reload right away
+func publishInvalidation(conn redis.Conn, config RedisConfig) {
+	if channel := config.InvalidationChannel; channel != "" {
+		if _, err := conn.Do("PUBLISH", channel, config.RuleListKeys); err != nil {
+			log.Fatalf("Failed to publish invalidation to %s: %v", channel, err)
+		}
+	}
+}
+
+// storeHash writes a rule in the flat hash format
+func storeHash(conn redis.Conn, ruleKey string, rule Rule) {
+	// Build hash fields
+	fields := []interface{}{
+		"name", rule.Name,
+		"enable", boolToInt(rule.Enable),
+		"priority", rule.Priority,
+		"type", rule.Type,
+		"mark_value", rule.MarkerValue,
+	}
+
+	tags := rule.Tags
+	if rule.Tag != "" {
+		tags = append([]string{rule.Tag}, tags...)
+	}
+	if len(tags) > 0 {
+		fields = append(fields, "tag", strings.Join(tags, ","))
+	}
+	if rule.MinVersion != "" {
+		fields = append(fields, "min_version", rule.MinVersion)
+	}
+	if rule.MaxVersion != "" {
+		fields = append(fields, "max_version", rule.MaxVersion)
+	}
+	if rule.MinExclusive {
+		fields = append(fields, "min_exclusive", 1)
+	}
+	if rule.MaxExclusive {
+		fields = append(fields, "max_exclusive", 1)
+	}
+	if rule.VersionConstraint != "" {
+		fields = append(fields, "version_constraint", rule.VersionConstraint)
+	}
+	if len(rule.PlatformVersions) > 0 {
+		platformVersions, err := json.Marshal(rule.PlatformVersions)
+		if err != nil {
+			log.Fatalf("Failed to encode platform versions of rule %s: %v", rule.Name, err)
+		}
+		fields = append(fields, "platform_versions", string(platformVersions))
+	}
+	if len(rule.Variants) > 0 {
+		variants := make([]string, 0, len(rule.Variants))
+		for _, variant := range rule.Variants {
+			variants = append(variants, fmt.Sprintf("%s:%d", variant.Value, variant.Weight))
+		}
+		fields = append(fields, "variants", strings.Join(variants, ","))
+	}
+	if rule.Salt != "" {
+		fields = append(fields, "salt", rule.Salt)
+	}
+	if rule.CanaryBps > 0 {
+		fields = append(fields, "canary_bps", rule.CanaryBps)
+	}
+	if len(rule.Buckets) > 0 {
+		buckets := make([]string, 0, len(rule.Buckets))
+		for _, bucket := range rule.Buckets {
+			buckets = append(buckets, fmt.Sprintf("%d-%d", bucket.From, bucket.To))
+		}
+		fields = append(fields, "buckets", strings.Join(buckets, ","))
+	}
+	if len(rule.UserIds) > 0 {
+		fields = append(fields, "user_ids", strings.Join(rule.UserIds, ","))
+	}
+	if rule.UserIdsKey != "" {
+		fields = append(fields, "user_ids_key", rule.UserIdsKey)
+	}
+	if rule.UserIdsLookup != "" {
+		fields = append(fields, "user_ids_lookup", rule.UserIdsLookup)
+	}
+	if rule.FailOpen {
+		fields = append(fields, "fail_open", 1)
+	}
+	if rule.Canary > 0 {
+		fields = append(fields, "canary", rule.Canary)
+	}
+	if rule.Path != "" {
+		fields = append(fields, "path", rule.Path)
+	}
+	if rule.PathMatch != "" {
+		fields = append(fields, "path_match", rule.PathMatch)
+	}
+	if rule.Conditions != nil {
+		conditions, err := json.Marshal(rule.Conditions)
+		if err != nil {
+			log.Fatalf("Failed to encode conditions of rule %s: %v", rule.Name, err)
+		}
+		fields = append(fields, "conditions", string(conditions))
+	}
+	if rule.Key != "" {
+		fields = append(fields, "key", rule.Key)
+	}
+	if rule.Operator != "" {
+		fields = append(fields, "operator", rule.Operator)
+	}
+	if len(rule.Values) > 0 {
+		fields = append(fields, "values", strings.Join(rule.Values, ","))
+	}
+	if len(rule.CIDRs) > 0 {
+		fields = append(fields, "cidrs", strings.Join(rule.CIDRs, ","))
+	}
+	if len(rule.Methods) > 0 {
+		fields = append(fields, "methods", strings.Join(rule.Methods, ","))
+	}
+	if len(rule.Hosts) > 0 {
+		fields = append(fields, "hosts", strings.Join(rule.Hosts, ","))
+	}
+	if rule.StartAt != "" {
+		fields = append(fields, "start_at", rule.StartAt)
+	}
+	if rule.EndAt != "" {
+		fields = append(fields, "end_at", rule.EndAt)
+	}
+	if len(rule.Schedules) > 0 {
+		schedules, err := json.Marshal(rule.Schedules)
+		if err != nil {
+			log.Fatalf("Failed to encode schedules of rule %s: %v", rule.Name, err)
+		}
+		fields = append(fields, "schedules", string(schedules))
+	}
+
+	// Store rule hash
+	if _, err := conn.Do("HSET", append([]interface{}{ruleKey}, fields...)...); err != nil {
+		log.Fatalf("Failed to set rule %s: %v", ruleKey, err)
+	}
 }
 
 func boolToInt(b bool) int {
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/qxsugar/request-marker/redis"
+)
+
+// versionedKey returns the key of one version of a rule set, e.g.
+// marker:api:rules:v42. It must agree with the plugin.
+func versionedKey(key, version string) string {
+	if version == "" {
+		return key
+	}
+	return key + ":v" + version
+}
+
+// newVersion returns the version to publish into. Published versions are
+// immutable, so an existing version is never reused.
+func newVersion(conn redis.Conn, config RedisConfig, requested string) string {
+	if requested != "" {
+		if versionExists(conn, config, requested) {
+			log.Fatalf("Version %s already exists, published versions are immutable", requested)
+		}
+		return requested
+	}
+	for {
+		seq, err := redis.Int64(conn.Do("INCR", config.RuleListKeys+":seq"))
+		if err != nil {
+			log.Fatalf("Failed to allocate a version: %v", err)
+		}
+		version := strconv.FormatInt(seq, 10)
+		if !versionExists(conn, config, version) {
+			return version
+		}
+	}
+}
+
+func versionExists(conn redis.Conn, config RedisConfig, version string) bool {
+	exists, err := redis.Bool(conn.Do("EXISTS", versionedKey(config.RuleListKeys, version)))
+	if err != nil {
+		log.Fatalf("Failed to check version %s: %v", version, err)
+	}
+	return exists
+}
+
+func activeVersion(conn redis.Conn, config RedisConfig) string {
+	if config.ActiveVersionKey == "" {
+		return ""
+	}
+	version, err := redis.String(conn.Do("GET", config.ActiveVersionKey))
+	if err != nil && err != redis.ErrNil {
+		log.Fatalf("Failed to read active version: %v", err)
+	}
+	return version
+}
+
+// listVersions prints every published version with its rule count
+func listVersions(conn redis.Conn, config RedisConfig) {
+	prefix := config.RuleListKeys + ":v"
+	var versions []string
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", 100))
+		if err != nil {
+			log.Fatalf("Failed to scan versions: %v", err)
+		}
+		cursor, _ = redis.String(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+		for _, key := range keys {
+			if version := strings.TrimPrefix(key, prefix); !strings.Contains(version, ":") {
+				versions = append(versions, version)
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		a, errA := strconv.Atoi(versions[i])
+		b, errB := strconv.Atoi(versions[j])
+		if errA != nil || errB != nil {
+			return versions[i] < versions[j]
+		}
+		return a < b
+	})
+
+	active := activeVersion(conn, config)
+	for _, version := range versions {
+		count, err := redis.Int(conn.Do("LLEN", versionedKey(config.RuleListKeys, version)))
+		if err != nil {
+			log.Fatalf("Failed to read version %s: %v", version, err)
+		}
+		marker := " "
+		if version == active {
+			marker = "*"
+		}
+		fmt.Printf("%s v%s  %d rules\n", marker, version, count)
+	}
+	if len(versions) == 0 {
+		fmt.Printf("No versions found under %s\n", prefix+"*")
+	}
+}
+
+// readVersion returns the fields of every rule of a version by rule name.
+// JSON documents are flattened to their top level fields.
+func readVersion(conn redis.Conn, config RedisConfig, version string) map[string]map[string]string {
+	listKey := versionedKey(config.RuleListKeys, version)
+	ruleKeys, err := redis.Strings(conn.Do("LRANGE", listKey, 0, -1))
+	if err != nil {
+		log.Fatalf("Failed to read version %s: %v", version, err)
+	}
+	if len(ruleKeys) == 0 {
+		log.Fatalf("Version %s not found (key=%s)", version, listKey)
+	}
+
+	rules := make(map[string]map[string]string, len(ruleKeys))
+	for _, ruleKey := range ruleKeys {
+		kind, err := redis.String(conn.Do("TYPE", ruleKey))
+		if err != nil {
+			log.Fatalf("Failed to read rule %s: %v", ruleKey, err)
+		}
+
+		fields := map[string]string{}
+		if kind == "string" {
+			data, err := redis.Bytes(conn.Do("GET", ruleKey))
+			if err != nil {
+				log.Fatalf("Failed to read rule %s: %v", ruleKey, err)
+			}
+			var document map[string]interface{}
+			if err := json.Unmarshal(data, &document); err != nil {
+				log.Fatalf("Failed to decode rule %s: %v", ruleKey, err)
+			}
+			for field, value := range document {
+				encoded, _ := json.Marshal(value)
+				fields[field] = string(encoded)
+			}
+		} else {
+			fields, err = redis.StringMap(conn.Do("HGETALL", ruleKey))
+			if err != nil {
+				log.Fatalf("Failed to read rule %s: %v", ruleKey, err)
+			}
+		}
+
+		name := strings.Trim(fields["name"], `"`)
+		if name == "" {
+			name = ruleKey
+		}
+		rules[name] = fields
+	}
+	return rules
+}
+
+// diffVersions prints the rules added, removed and changed between two versions
+func diffVersions(conn redis.Conn, config RedisConfig, from, to string) {
+	if from == "" || to == "" {
+		log.Fatalf("Usage: load-config diff <from-version> <to-version>")
+	}
+	before := readVersion(conn, config, from)
+	after := readVersion(conn, config, to)
+
+	names := make([]string, 0, len(before)+len(after))
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := 0
+	for _, name := range names {
+		old, inBefore := before[name]
+		updated, inAfter := after[name]
+		switch {
+		case !inBefore:
+			fmt.Printf("+ %s\n", name)
+		case !inAfter:
+			fmt.Printf("- %s\n", name)
+		default:
+			lines := diffFields(old, updated)
+			if len(lines) == 0 {
+				continue
+			}
+			fmt.Printf("~ %s\n", name)
+			for _, line := range lines {
+				fmt.Printf("    %s\n", line)
+			}
+		}
+		changes++
+	}
+	if changes == 0 {
+		fmt.Printf("No differences between v%s and v%s\n", from, to)
+	}
+}
+
+func diffFields(before, after map[string]string) []string {
+	fields := make([]string, 0, len(before)+len(after))
+	for field := range before {
+		fields = append(fields, field)
+	}
+	for field := range after {
+		if _, ok := before[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	var lines []string
+	for _, field := range fields {
+		old, inBefore := before[field]
+		updated, inAfter := after[field]
+		switch {
+		case !inBefore:
+			lines = append(lines, fmt.Sprintf("%s: + %s", field, updated))
+		case !inAfter:
+			lines = append(lines, fmt.Sprintf("%s: - %s", field, old))
+		case old != updated:
+			lines = append(lines, fmt.Sprintf("%s: %s -> %s", field, old, updated))
+		}
+	}
+	return lines
+}
+
+// activateVersion points the active version key at a published version, which
+// publishes it or rolls back to it in a single atomic write
+func activateVersion(conn redis.Conn, config RedisConfig, version string) {
+	if config.ActiveVersionKey == "" {
+		log.Fatalf("redisConfig.activeVersionKey is not configured")
+	}
+	if version == "" {
+		log.Fatalf("Usage: load-config activate <version>")
+	}
+	if !versionExists(conn, config, version) {
+		log.Fatalf("Version %s not found", version)
+	}
+
+	previous := activeVersion(conn, config)
+	if _, err := conn.Do("SET", config.ActiveVersionKey, version); err != nil {
+		log.Fatalf("Failed to activate version %s: %v", version, err)
+	}
+	publishInvalidation(conn, config)
+
+	if previous == "" {
+		fmt.Printf("✓ Activated version %s\n", version)
+	} else {
+		fmt.Printf("✓ Activated version %s (previously %s)\n", version, previous)
+	}
+}
@@ -0,0 +1,128 @@
+package request_marker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ruleFile is the document of a rule file. Rules use the json field names of
+// Rule in both JSON and YAML files.
+type ruleFile struct {
+	SchemaVersion int    `json:"schemaVersion" yaml:"schemaVersion"` // 文件格式版本，当前为 1
+	Rules         []Rule `json:"rules" yaml:"rules"`                 // 规则列表
+}
+
+// fileState identifies the last rule file that was applied, so that polling
+// an unchanged file costs a single stat call.
+type fileState struct {
+	modTime time.Time
+	size    int64
+	hash    uint64
+}
+
+// fileSource loads rules from a JSON or YAML file.
+type fileSource struct {
+	config FileConfig
+	tag    string
+	state  fileState
+}
+
+// load reloads the rule file when its modification time, size or content
+// changed. A file that cannot be read or contains an invalid rule is rejected
+// as a whole.
+func (s *fileSource) load() (*ruleSet, error) {
+	path := s.config.Path
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat rule file: %w", err)
+	}
+
+	applied := !s.state.modTime.IsZero()
+	if applied && info.ModTime().Equal(s.state.modTime) && info.Size() == s.state.size {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rule file: %w", err)
+	}
+
+	// Mounted ConfigMaps are often rewritten with the same content
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	state := fileState{modTime: info.ModTime(), size: info.Size(), hash: h.Sum64()}
+	if applied && state.hash == s.state.hash {
+		s.state = state
+		return nil, nil
+	}
+
+	rules, err := parseRuleFile(path, data, s.tag)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule file %s: %w", path, err)
+	}
+	return &ruleSet{rules: rules, source: ruleSourceFile, commit: func() { s.state = state }}, nil
+}
+
+// parseRuleFile decodes a JSON or YAML rule file and returns the validated and
+// compiled rules serving tag.
+func parseRuleFile(path string, data []byte, tag string) ([]Rule, error) {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return decodeRules(data, tag)
+	}
+	file, err := decodeRuleFileYAML(data)
+	if err != nil {
+		return nil, err
+	}
+	return prepareRuleFile(file, tag)
+}
+
+// decodeRules decodes a JSON rule document as served by rule files and the
+// HTTP rule service.
+func decodeRules(data []byte, tag string) ([]Rule, error) {
+	var file ruleFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("failed to decode rules: %w", err)
+	}
+	return prepareRuleFile(file, tag)
+}
+
+// prepareRuleFile validates and compiles the rules of a decoded rule document
+// and returns those serving tag. Any invalid rule rejects the whole document.
+func prepareRuleFile(file ruleFile, tag string) ([]Rule, error) {
+	if file.SchemaVersion != ruleSchemaVersion {
+		return nil, fmt.Errorf("unsupported rule schema version %d, expected %d", file.SchemaVersion, ruleSchemaVersion)
+	}
+	if len(file.Rules) == 0 {
+		return nil, fmt.Errorf("no rules found")
+	}
+
+	rules := make([]Rule, 0, len(file.Rules))
+	for i, rule := range file.Rules {
+		// Cohorts in Redis sets cannot be loaded or looked up without Redis
+		err := rule.walk(func(r *Rule) error {
+			if r.UserIdsKey != "" {
+				return fmt.Errorf("userIdsKey requires redisConfig")
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %w", i, rule.Name, err)
+		}
+		rule, err := prepareRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %w", i, rule.Name, err)
+		}
+		if rule.hasTag(tag) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
@@ -0,0 +1,154 @@
+package request_marker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testRuleFileYAML = `schemaVersion: 1
+rules:
+  - tag: api
+    name: beta
+    enable: true
+    priority: 10
+    type: identify
+    markerValue: beta
+    userIds: [u1, u2]
+  - tags: [api, web]
+    name: admin
+    enable: true
+    type: path
+    path: /admin
+    markerValue: admin
+  - tag: web
+    name: web-only
+    enable: true
+    type: path
+    path: /
+    markerValue: web
+`
+
+func TestParseRuleFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		data     string
+		expected int
+		wantErr  bool
+	}{
+		{"yaml", "rules.yaml", testRuleFileYAML, 2, false},
+		{"json", "rules.json", `{"schemaVersion":1,"rules":[{"tag":"api","name":"a","type":"path","path":"/","markerValue":"a"}]}`, 1, false},
+		{"missing schema version", "rules.yaml", "rules:\n  - {tag: api, name: a, type: path, path: /, markerValue: a}", 0, true},
+		{"unknown field", "rules.yaml", "schemaVersion: 1\nrules:\n  - {tag: api, name: a, type: path, path: /, markValue: a}", 0, true},
+		{"invalid rule", "rules.yaml", "schemaVersion: 1\nrules:\n  - {tag: api, name: a, type: path, markerValue: a}", 0, true},
+		{"user ids key", "rules.yaml", "schemaVersion: 1\nrules:\n  - {tag: api, name: a, type: identify, userIdsKey: beta, markerValue: a}", 0, true},
+		{"user ids key in leaf", "rules.json", `{"schemaVersion":1,"rules":[{"tag":"api","name":"a","type":"composite","markerValue":"a","conditions":{"not":{"type":"identify","userIdsKey":"beta"}}}]}`, 0, true},
+		{"numeric scalars", "rules.yaml", "schemaVersion: 1\nrules:\n  - {tag: api, name: a, type: identify, userIds: [1001, 1002], markerValue: a}\n  - {tag: api, name: b, type: version, minVersion: 3, markerValue: b}", 2, false},
+		{"no rules", "rules.yaml", "schemaVersion: 1\nrules: []", 0, true},
+		{"malformed yaml", "rules.yaml", "schemaVersion: 1\nrules: [", 0, true},
+		{"malformed json", "rules.json", `{"schemaVersion":1,`, 0, true},
+	}
+
+	for _, tt := range tests {
+		rules, err := parseRuleFile(tt.path, []byte(tt.data), "api")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+			continue
+		}
+		if len(rules) != tt.expected {
+			t.Errorf("%s: expected %d rules, got %d", tt.name, tt.expected, len(rules))
+		}
+	}
+}
+
+func TestRefreshFileConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	modTime := time.Now().Add(-time.Hour)
+	write := func(data string) {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatalf("failed to write rule file: %v", err)
+		}
+		// Coarse file system timestamps must not hide a change
+		modTime = modTime.Add(time.Second)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("failed to set rule file time: %v", err)
+		}
+	}
+
+	marker := &Marker{
+		next:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		logger: NewLogger("DEBUG"),
+		config: &Config{Tag: "api", MarkerKey: "X-MARK", FileConfig: FileConfig{Enable: true, Path: path}},
+	}
+
+	if err := marker.refreshConfig(); err == nil {
+		t.Fatalf("expected a missing rule file to fail")
+	}
+
+	write(testRuleFileYAML)
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(marker.config.StaticRules) != 2 || marker.snapshot.source != ruleSourceFile {
+		t.Fatalf("expected 2 rules from file, got %d from %s", len(marker.config.StaticRules), marker.snapshot.source)
+	}
+	loaded := marker.snapshot
+
+	// An unchanged or rewritten but identical file only refreshes the age
+	time.Sleep(10 * time.Millisecond)
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	write(testRuleFileYAML)
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if marker.snapshot.version != loaded.version || !marker.snapshot.loadedAt.After(loaded.loadedAt) {
+		t.Errorf("expected snapshot %s to be kept and touched", loaded.version)
+	}
+
+	write("schemaVersion: 1\nrules:\n  - {tag: api, name: broken, type: path, markerValue: broken}")
+	if err := marker.refreshConfig(); err == nil {
+		t.Fatalf("expected an invalid rule file to be rejected")
+	}
+	if marker.snapshot.version != loaded.version || marker.snapshot.failures != 1 {
+		t.Errorf("expected snapshot %s to be kept after a rejected file", loaded.version)
+	}
+
+	write("schemaVersion: 1\nrules:\n  - {tag: api, name: all, type: path, path: /, markerValue: all}")
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(marker.config.StaticRules) != 1 || marker.config.StaticRules[0].Name != "all" {
+		t.Errorf("expected the changed file to be applied, got %+v", marker.config.StaticRules)
+	}
+}
+
+func TestNew_FileConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(testRuleFileYAML), 0o644); err != nil {
+		t.Fatalf("failed to write rule file: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config := CreateConfig()
+	config.Tag = "api"
+	config.MarkerKey = "X-MARK"
+	config.FileConfig = FileConfig{Enable: true, Path: path}
+	handler, err := New(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/admin", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if req.Header.Get("X-MARK") != "admin" {
+		t.Errorf("expected file rules to be served on startup, got %q", req.Header.Get("X-MARK"))
+	}
+}
@@ -0,0 +1,98 @@
+package request_marker
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultHTTPSourceTimeout = 5 * time.Second
+	maxHTTPRulesSize         = 10 << 20
+)
+
+// httpSource pulls rules from a rule service, e.g. GET /rules?tag=api. The
+// response is a JSON rule document like a rule file, and the ETag of the
+// applied document is sent back in If-None-Match so that unchanged rules cost
+// a 304.
+type httpSource struct {
+	client *http.Client
+	url    string
+	token  string
+	tag    string
+	etag   string
+}
+
+func newHTTPSource(config HTTPConfig, tag string) *httpSource {
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultHTTPSourceTimeout
+	}
+	return &httpSource{
+		client: &http.Client{Timeout: timeout},
+		url:    rulesURL(config.URL, tag),
+		token:  config.BearerToken,
+		tag:    tag,
+	}
+}
+
+// rulesURL adds the middleware tag as the tag query parameter unless the URL
+// already sets one.
+func rulesURL(rawURL, tag string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || tag == "" {
+		return rawURL
+	}
+	query := u.Query()
+	if query.Get("tag") != "" {
+		return rawURL
+	}
+	query.Set("tag", tag)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (s *httpSource) load() (*ruleSet, error) {
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule service url: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	if s.etag != "" {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch rules: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("unexpected status %s from rule service", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPRulesSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+	if len(data) > maxHTTPRulesSize {
+		return nil, fmt.Errorf("rules exceed %d bytes", maxHTTPRulesSize)
+	}
+
+	rules, err := decodeRules(data, s.tag)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules from rule service: %w", err)
+	}
+	etag := resp.Header.Get("ETag")
+	return &ruleSet{rules: rules, source: ruleSourceHTTP, commit: func() { s.etag = etag }}, nil
+}
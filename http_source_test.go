@@ -0,0 +1,102 @@
+package request_marker
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRulesURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		tag      string
+		expected string
+	}{
+		{"http://rules/rules", "api", "http://rules/rules?tag=api"},
+		{"http://rules/rules?env=prod", "api", "http://rules/rules?env=prod&tag=api"},
+		{"http://rules/rules?tag=web", "api", "http://rules/rules?tag=web"},
+		{"http://rules/rules", "", "http://rules/rules"},
+	}
+
+	for _, tt := range tests {
+		if got := rulesURL(tt.url, tt.tag); got != tt.expected {
+			t.Errorf("rulesURL(%q, %q): expected %s, got %s", tt.url, tt.tag, tt.expected, got)
+		}
+	}
+}
+
+func TestHTTPSource(t *testing.T) {
+	document := `{"schemaVersion":1,"rules":[{"tag":"api","name":"beta","type":"path","path":"/beta","markerValue":"beta"}]}`
+	etag := `"v1"`
+	status := http.StatusOK
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Query().Get("tag") != "api" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, document)
+	}))
+	defer server.Close()
+
+	marker := &Marker{
+		next:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		logger: NewLogger("DEBUG"),
+		config: &Config{
+			Tag:        "api",
+			MarkerKey:  "X-MARK",
+			HTTPConfig: HTTPConfig{Enable: true, URL: server.URL + "/rules", BearerToken: "secret"},
+		},
+	}
+	source := newHTTPSource(marker.config.HTTPConfig, marker.config.Tag)
+	marker.source = source
+
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(marker.config.StaticRules) != 1 || marker.snapshot.source != ruleSourceHTTP || source.etag != etag {
+		t.Fatalf("expected 1 rule from http with etag %s, got %d from %s with %s", etag, len(marker.config.StaticRules), marker.snapshot.source, source.etag)
+	}
+	loaded := marker.snapshot
+
+	// An unchanged document is answered with 304 and keeps the snapshot
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if marker.snapshot.version != loaded.version || requests != 2 {
+		t.Errorf("expected snapshot %s to be kept after a 304", loaded.version)
+	}
+
+	// Invalid rules are rejected and their etag is not remembered
+	document, etag = `{"schemaVersion":1,"rules":[{"tag":"api","name":"broken","type":"path","markerValue":"broken"}]}`, `"v2"`
+	if err := marker.refreshConfig(); err == nil {
+		t.Fatalf("expected invalid rules to be rejected")
+	}
+	if marker.snapshot.version != loaded.version || source.etag != `"v1"` {
+		t.Errorf("expected snapshot %s and etag \"v1\" to be kept, got etag %s", loaded.version, source.etag)
+	}
+
+	status = http.StatusInternalServerError
+	if err := marker.refreshConfig(); err == nil {
+		t.Fatalf("expected a server error to fail the refresh")
+	}
+	if marker.snapshot.version != loaded.version || marker.snapshot.failures != 2 {
+		t.Errorf("expected snapshot %s to be kept after a server error", loaded.version)
+	}
+
+	marker.config.HTTPConfig.BearerToken = "wrong"
+	if _, err := newHTTPSource(marker.config.HTTPConfig, marker.config.Tag).load(); err == nil {
+		t.Errorf("expected a rejected token to fail the load")
+	}
+}
@@ -0,0 +1,233 @@
+package request_marker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// hashIdentify hashes the request identity with FNV-1a. A non-empty salt is
+// prepended so that rules with different salts bucket users independently.
+func (mk *Marker) hashIdentify(req *http.Request, salt string) (int, error) {
+	identify, source, err := mk.bucketIdentify(req)
+	if err != nil {
+		return 0, err
+	}
+	mk.logger.Debug(fmt.Sprintf("Bucketing request by identity source: %s", source))
+
+	h := fnv.New32a()
+	if salt != "" {
+		_, _ = h.Write([]byte(salt + ":"))
+	}
+	_, _ = h.Write([]byte(identify))
+	return int(h.Sum32()), nil
+}
+
+// identifySource is an IdentifySource with its path pattern compiled.
+type identifySource struct {
+	IdentifySource
+	pattern *regexp.Regexp
+}
+
+func compileIdentifySources(sources []IdentifySource, jwtEnabled bool) ([]identifySource, error) {
+	compiled := make([]identifySource, 0, len(sources))
+	for i, source := range sources {
+		c := identifySource{IdentifySource: source}
+		switch source.Type {
+		case IdentifySourceHeader, IdentifySourceCookie, IdentifySourceQuery:
+			if source.Key == "" {
+				return nil, fmt.Errorf("identify source %d: %s requires key", i, source.Type)
+			}
+		case IdentifySourceJWT:
+			if !jwtEnabled {
+				return nil, fmt.Errorf("identify source %d: jwt requires jwt to be enabled", i)
+			}
+		case IdentifySourceIP:
+		case IdentifySourcePath:
+			if source.Pattern == "" {
+				return nil, fmt.Errorf("identify source %d: path requires pattern", i)
+			}
+			re, err := regexp.Compile(source.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("identify source %d: invalid pattern %q: %w", i, source.Pattern, err)
+			}
+			c.pattern = re
+		default:
+			return nil, fmt.Errorf("identify source %d: unknown type %q", i, source.Type)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// legacyIdentifySources mirrors the fixed jwt -> header -> cookie -> query
+// order used before identifySources existed.
+func legacyIdentifySources(config *Config, jwtEnabled bool) []identifySource {
+	var sources []identifySource
+	if jwtEnabled {
+		sources = append(sources, identifySource{IdentifySource: IdentifySource{Type: IdentifySourceJWT}})
+	}
+	if config.IdentifyHeader != "" {
+		sources = append(sources, identifySource{IdentifySource: IdentifySource{Type: IdentifySourceHeader, Key: config.IdentifyHeader}})
+	}
+	if config.IdentifyCookie != "" {
+		sources = append(sources, identifySource{IdentifySource: IdentifySource{Type: IdentifySourceCookie, Key: config.IdentifyCookie}})
+	}
+	if config.IdentifyQuery != "" {
+		sources = append(sources, identifySource{IdentifySource: IdentifySource{Type: IdentifySourceQuery, Key: config.IdentifyQuery}})
+	}
+	return sources
+}
+
+func (mk *Marker) extractIdentify(req *http.Request) (string, error) {
+	sources := mk.identifySources
+	if sources == nil {
+		sources = legacyIdentifySources(mk.config, mk.jwt != nil)
+	}
+
+	for _, source := range sources {
+		if identify := source.normalize(mk.extractFromSource(source, req)); identify != "" {
+			return identify, nil
+		}
+	}
+
+	return "", fmt.Errorf("identify not found in any identify source")
+}
+
+func (mk *Marker) extractFromSource(source identifySource, req *http.Request) string {
+	switch source.Type {
+	case IdentifySourceHeader:
+		return req.Header.Get(source.Key)
+	case IdentifySourceCookie:
+		cookie, err := req.Cookie(source.Key)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	case IdentifySourceQuery:
+		return req.URL.Query().Get(source.Key)
+	case IdentifySourceJWT:
+		if mk.jwt == nil {
+			return ""
+		}
+		claim := source.Key
+		if claim == "" {
+			claim = mk.jwt.claim
+		}
+		value, _ := mk.extractClaim(claim, req)
+		return value
+	case IdentifySourceIP:
+		if ip := mk.clientIP(req); ip != nil {
+			return ip.String()
+		}
+	case IdentifySourcePath:
+		if source.pattern == nil {
+			return ""
+		}
+		match := source.pattern.FindStringSubmatch(req.URL.Path)
+		if match == nil {
+			return ""
+		}
+		if i := source.pattern.SubexpIndex("id"); i > 0 {
+			return match[i]
+		}
+		if len(match) > 1 {
+			return match[1]
+		}
+		return match[0]
+	}
+	return ""
+}
+
+func (s identifySource) normalize(value string) string {
+	if s.TrimSpace {
+		value = strings.TrimSpace(value)
+	}
+	if s.TrimPrefix != "" {
+		value = strings.TrimPrefix(value, s.TrimPrefix)
+	}
+	if s.Lowercase {
+		value = strings.ToLower(value)
+	}
+	return value
+}
+
+// bucketIdentify returns the identity canary and split rules hash on, and the
+// source it came from. Anonymous requests use the visitor cookie when enabled,
+// then the configured identifyFallbacks in order; identify rules never use
+// either.
+func (mk *Marker) bucketIdentify(req *http.Request) (string, string, error) {
+	identify, err := mk.extractIdentify(req)
+	if err == nil {
+		return identify, "user", nil
+	}
+
+	if id := mk.visitorID(req); id != "" {
+		return "visitor:" + id, "visitor", nil
+	}
+
+	for _, fallback := range mk.config.IdentifyFallbacks {
+		switch fallback {
+		case IdentifyFallbackIP:
+			if ip := mk.clientIP(req); ip != nil {
+				return "ip:" + ip.String(), string(fallback), nil
+			}
+		case IdentifyFallbackHeaders:
+			if value := fingerprintHeaders(req, mk.config.IdentifyFallbackHeaders); value != "" {
+				return "headers:" + value, string(fallback), nil
+			}
+		case IdentifyFallbackRandom:
+			id, err := randomID()
+			if err != nil {
+				return "", "", err
+			}
+			return "random:" + id, string(fallback), nil
+		}
+	}
+	return "", "", err
+}
+
+// fingerprintHeaders joins the values of the given headers, or returns an
+// empty string when none of them is present.
+func fingerprintHeaders(req *http.Request, headers []string) string {
+	values := make([]string, 0, len(headers))
+	present := false
+	for _, header := range headers {
+		value := req.Header.Get(header)
+		if value != "" {
+			present = true
+		}
+		values = append(values, value)
+	}
+	if !present {
+		return ""
+	}
+	return strings.Join(values, "\n")
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate random id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func validateIdentifyFallbacks(config *Config) error {
+	for _, fallback := range config.IdentifyFallbacks {
+		switch fallback {
+		case IdentifyFallbackIP, IdentifyFallbackRandom:
+		case IdentifyFallbackHeaders:
+			if len(config.IdentifyFallbackHeaders) == 0 {
+				return fmt.Errorf("identify fallback headers requires identifyFallbackHeaders")
+			}
+		default:
+			return fmt.Errorf("unknown identify fallback: %s", fallback)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package request_marker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBucketIdentify_Fallbacks(t *testing.T) {
+	tests := []struct {
+		name      string
+		fallbacks []IdentifyFallback
+		userID    string
+		userAgent string
+		source    string
+		identify  string
+	}{
+		{"user id wins", []IdentifyFallback{IdentifyFallbackIP}, "user001", "", "user", "user001"},
+		{"ip fallback", []IdentifyFallback{IdentifyFallbackIP}, "", "", "ip", "ip:192.0.2.10"},
+		{"headers fallback", []IdentifyFallback{IdentifyFallbackHeaders, IdentifyFallbackIP}, "", "Mozilla/5.0", "headers", "headers:Mozilla/5.0\n"},
+		{"headers absent falls through", []IdentifyFallback{IdentifyFallbackHeaders, IdentifyFallbackIP}, "", "", "ip", "ip:192.0.2.10"},
+		{"random fallback", []IdentifyFallback{IdentifyFallbackRandom}, "", "", "random", ""},
+	}
+
+	for _, tt := range tests {
+		config := &Config{
+			IdentifyHeader:          "X-User-ID",
+			IdentifyFallbacks:       tt.fallbacks,
+			IdentifyFallbackHeaders: []string{"User-Agent", "Accept-Language"},
+		}
+		marker := &Marker{config: config, logger: NewLogger("DEBUG")}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.0.2.10:4321"
+		req.Header.Del("User-Agent")
+		if tt.userID != "" {
+			req.Header.Set("X-User-ID", tt.userID)
+		}
+		if tt.userAgent != "" {
+			req.Header.Set("User-Agent", tt.userAgent)
+		}
+
+		identify, source, err := marker.bucketIdentify(req)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if source != tt.source {
+			t.Errorf("%s: expected source %s, got %s", tt.name, tt.source, source)
+		}
+		if tt.identify != "" && identify != tt.identify {
+			t.Errorf("%s: expected identify %q, got %q", tt.name, tt.identify, identify)
+		}
+	}
+}
+
+func TestBucketIdentify_NoFallback(t *testing.T) {
+	marker := &Marker{config: &Config{IdentifyHeader: "X-User-ID"}, logger: NewLogger("DEBUG")}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	if _, _, err := marker.bucketIdentify(req); err == nil {
+		t.Errorf("expected error for anonymous request without fallbacks")
+	}
+}
+
+func TestMarkerServeHTTP_CanaryAnonymousFallback(t *testing.T) {
+	config := &Config{
+		Tag:               "api",
+		LogLevel:          "DEBUG",
+		MarkerKey:         "X-MARK",
+		IdentifyHeader:    "X-User-ID",
+		IdentifyFallbacks: []IdentifyFallback{IdentifyFallbackIP},
+		StaticRules: []Rule{
+			{
+				Tag:         "api",
+				Name:        "canary-all",
+				Enable:      true,
+				Priority:    100,
+				Type:        RuleTypeCanary,
+				MarkerValue: "canary",
+				Canary:      100,
+			},
+			{
+				Tag:         "api",
+				Name:        "beta",
+				Enable:      true,
+				Priority:    200,
+				Type:        RuleTypeIdentify,
+				MarkerValue: "beta",
+				UserIds:     []string{"ip:192.0.2.10"},
+			},
+		},
+	}
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.10:4321"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The fallback identity is only used for bucketing, never for identify rules
+	if req.Header.Get("X-MARK") != "canary" {
+		t.Errorf("expected X-MARK=canary for anonymous request, got %s", req.Header.Get("X-MARK"))
+	}
+}
+
+func TestNew_InvalidIdentifyFallback(t *testing.T) {
+	tests := []*Config{
+		{IdentifyFallbacks: []IdentifyFallback{"device"}},
+		{IdentifyFallbacks: []IdentifyFallback{IdentifyFallbackHeaders}},
+	}
+
+	for _, config := range tests {
+		_, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "test")
+		if err == nil {
+			t.Errorf("expected error for identifyFallbacks %v", config.IdentifyFallbacks)
+		}
+	}
+}
+
+func TestExtractIdentify_Sources(t *testing.T) {
+	tests := []struct {
+		name     string
+		sources  []IdentifySource
+		expected string
+	}{
+		{"cookie before query", []IdentifySource{{Type: IdentifySourceCookie, Key: "uid"}, {Type: IdentifySourceQuery, Key: "uid"}}, "fresh"},
+		{"query before cookie", []IdentifySource{{Type: IdentifySourceQuery, Key: "uid"}, {Type: IdentifySourceCookie, Key: "uid"}}, "stale"},
+		{"missing header skipped", []IdentifySource{{Type: IdentifySourceHeader, Key: "X-User-ID"}, {Type: IdentifySourceCookie, Key: "uid"}}, "fresh"},
+		{"header normalised", []IdentifySource{{Type: IdentifySourceHeader, Key: "X-Account", TrimSpace: true, TrimPrefix: "acct-", Lowercase: true}}, "abc42"},
+		{"ip", []IdentifySource{{Type: IdentifySourceIP}}, "192.0.2.10"},
+		{"path named group", []IdentifySource{{Type: IdentifySourcePath, Pattern: `^/users/(?P<id>[^/]+)/`}}, "u-77"},
+		{"path first group", []IdentifySource{{Type: IdentifySourcePath, Pattern: `^/users/([^/]+)`}}, "u-77"},
+		{"path no match", []IdentifySource{{Type: IdentifySourcePath, Pattern: `^/teams/(\w+)`}}, ""},
+	}
+
+	for _, tt := range tests {
+		sources, err := compileIdentifySources(tt.sources, false)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		marker := &Marker{config: &Config{}, identifySources: sources}
+
+		req := httptest.NewRequest("GET", "/users/u-77/orders?uid=stale", nil)
+		req.RemoteAddr = "192.0.2.10:4321"
+		req.Header.Set("X-Account", "  acct-ABC42 ")
+		req.AddCookie(&http.Cookie{Name: "uid", Value: "fresh"})
+
+		identify, err := marker.extractIdentify(req)
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected error, got %s", tt.name, identify)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if identify != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, identify)
+		}
+	}
+}
+
+func TestCompileIdentifySources_Invalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		source IdentifySource
+	}{
+		{"header without key", IdentifySource{Type: IdentifySourceHeader}},
+		{"jwt disabled", IdentifySource{Type: IdentifySourceJWT}},
+		{"path without pattern", IdentifySource{Type: IdentifySourcePath}},
+		{"invalid path pattern", IdentifySource{Type: IdentifySourcePath, Pattern: "("}},
+		{"unknown type", IdentifySource{Type: "device"}},
+	}
+
+	for _, tt := range tests {
+		if _, err := compileIdentifySources([]IdentifySource{tt.source}, false); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestMarkerServeHTTP_IdentifySourcesReplaceLegacy(t *testing.T) {
+	config := &Config{
+		Tag:            "api",
+		MarkerKey:      "X-MARK",
+		IdentifyHeader: "X-User-ID",
+		IdentifySources: []IdentifySource{
+			{Type: IdentifySourceCookie, Key: "uid"},
+		},
+		StaticRules: []Rule{
+			{
+				Tag:         "api",
+				Name:        "beta",
+				Enable:      true,
+				Priority:    100,
+				Type:        RuleTypeIdentify,
+				MarkerValue: "beta",
+				UserIds:     []string{"user001"},
+			},
+		},
+	}
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-User-ID", "user001")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if req.Header.Get("X-MARK") != "" {
+		t.Errorf("expected legacy identifyHeader to be ignored, got X-MARK=%s", req.Header.Get("X-MARK"))
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "uid", Value: "user001"})
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if req.Header.Get("X-MARK") != "beta" {
+		t.Errorf("expected X-MARK=beta, got %s", req.Header.Get("X-MARK"))
+	}
+}
@@ -0,0 +1,107 @@
+package request_marker
+
+import (
+	"context"
+	"fmt"
+	"github.com/qxsugar/request-marker/redis"
+	"time"
+)
+
+const (
+	invalidationPingInterval = 30 * time.Second
+	invalidationReadTimeout  = time.Minute
+)
+
+// watchInvalidations keeps a subscription to the invalidation channel open and
+// signals trigger for every message. A dropped subscription is re-established
+// right away and then with exponential backoff while Redis stays unreachable.
+func (mk *Marker) watchInvalidations(ctx context.Context, channel string, trigger chan<- struct{}) {
+	failures := 0
+	for {
+		subscribed, err := mk.subscribeInvalidations(ctx, channel, trigger)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if subscribed {
+			failures = 0
+			mk.logger.Error(fmt.Sprintf("Lost subscription to invalidation channel %s, resubscribing: %v", channel, err))
+			continue
+		}
+
+		failures++
+		delay := retryBackoff(failures, maxRetryBackoff)
+		mk.logger.Error(fmt.Sprintf("Failed to subscribe to invalidation channel %s (attempt %d, retrying in %s): %v", channel, failures, delay, err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// subscribeInvalidations runs a single subscription until the connection
+// fails or ctx is done. It reports whether the subscription was confirmed.
+func (mk *Marker) subscribeInvalidations(ctx context.Context, channel string, trigger chan<- struct{}) (bool, error) {
+	// A dedicated connection, so that closing it from another goroutine never
+	// races with the pool draining a subscribed connection.
+	conn, err := dialRedis(ctx, mk.redisPool)
+	if err != nil {
+		return false, err
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+
+	if err := psc.Subscribe(channel); err != nil {
+		return false, err
+	}
+
+	// Pings keep replies flowing so that a silently dropped connection shows
+	// up as a read timeout; closing the connection unblocks Receive on ctx.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(invalidationPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				psc.Close()
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := psc.Ping(""); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	subscribed := false
+	for {
+		switch v := psc.ReceiveWithTimeout(invalidationReadTimeout).(type) {
+		case redis.Subscription:
+			if v.Kind == "subscribe" {
+				subscribed = true
+				mk.logger.Info(fmt.Sprintf("Subscribed to invalidation channel %s", v.Channel))
+				// Catch up on anything published while we were not listening
+				notify(trigger)
+			}
+		case redis.Message:
+			mk.logger.Debug(fmt.Sprintf("Received invalidation on %s: %s", v.Channel, v.Data))
+			notify(trigger)
+		case redis.Pong:
+		case error:
+			return subscribed, v
+		}
+	}
+}
+
+// notify signals trigger without blocking; pending signals are coalesced.
+func notify(trigger chan<- struct{}) {
+	select {
+	case trigger <- struct{}{}:
+	default:
+	}
+}
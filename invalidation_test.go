@@ -0,0 +1,135 @@
+package request_marker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qxsugar/request-marker/redis"
+)
+
+// fakePubSubConn answers SUBSCRIBE and PING like Redis and delivers queued
+// messages until it is closed or dropped.
+type fakePubSubConn struct {
+	replies chan interface{}
+	once    sync.Once
+	closed  chan struct{}
+}
+
+func newFakePubSubConn() *fakePubSubConn {
+	return &fakePubSubConn{replies: make(chan interface{}, 16), closed: make(chan struct{})}
+}
+
+func (c *fakePubSubConn) publish(channel, data string) {
+	c.replies <- []interface{}{[]byte("message"), []byte(channel), []byte(data)}
+}
+
+func (c *fakePubSubConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakePubSubConn) Err() error   { return nil }
+func (c *fakePubSubConn) Flush() error { return nil }
+
+func (c *fakePubSubConn) Send(cmd string, args ...interface{}) error {
+	switch cmd {
+	case "SUBSCRIBE":
+		c.replies <- []interface{}{[]byte("subscribe"), []byte(fmt.Sprint(args[0])), int64(1)}
+	case "PING":
+		c.replies <- []interface{}{[]byte("pong"), []byte("")}
+	}
+	return nil
+}
+
+func (c *fakePubSubConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (c *fakePubSubConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return nil, nil
+}
+
+func (c *fakePubSubConn) Receive() (interface{}, error) {
+	return c.ReceiveWithTimeout(0)
+}
+
+func (c *fakePubSubConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	select {
+	case reply := <-c.replies:
+		return reply, nil
+	case <-c.closed:
+		return nil, errors.New("use of closed connection")
+	}
+}
+
+func TestWatchInvalidations_TriggersAndResubscribes(t *testing.T) {
+	first, second := newFakePubSubConn(), newFakePubSubConn()
+	conns := make(chan *fakePubSubConn, 2)
+	conns <- first
+	conns <- second
+
+	marker := &Marker{
+		logger: NewLogger("DEBUG"),
+		config: &Config{},
+		redisPool: &redis.Pool{Dial: func() (redis.Conn, error) {
+			select {
+			case conn := <-conns:
+				return conn, nil
+			default:
+				return nil, errors.New("connection refused")
+			}
+		}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	trigger := make(chan struct{}, 1)
+	go marker.watchInvalidations(ctx, "marker:api:invalidate", trigger)
+
+	expectTrigger := func(reason string) {
+		select {
+		case <-trigger:
+		case <-time.After(time.Second):
+			t.Fatalf("expected a refresh trigger %s", reason)
+		}
+	}
+
+	expectTrigger("after subscribing")
+	first.publish("marker:api:invalidate", "kill-switch")
+	expectTrigger("for a published message")
+
+	// Dropping the connection resubscribes on a new one and catches up
+	first.Close()
+	expectTrigger("after resubscribing")
+	second.publish("marker:api:invalidate", "rollout")
+	expectTrigger("for a message on the new subscription")
+}
+
+func TestRefreshLoop_RefreshesOnTrigger(t *testing.T) {
+	conn := snapshotConn("a")
+	marker := newSnapshotMarker(conn, SnapshotPolicy{})
+	marker.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	trigger := make(chan struct{}, 1)
+	go marker.refreshLoop(ctx, time.Hour, 0, trigger)
+
+	trigger <- struct{}{}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		marker.mu.RLock()
+		source := marker.snapshot.source
+		marker.mu.RUnlock()
+		if source == ruleSourceRedis {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("expected the trigger to refresh rules before the hourly tick")
+}
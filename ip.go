@@ -0,0 +1,137 @@
+package request_marker
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ipTrie is a binary prefix tree of CIDR ranges. Lookups cost at most one step
+// per address bit regardless of how many ranges were inserted.
+type ipTrie struct {
+	v4 *ipTrieNode
+	v6 *ipTrieNode
+}
+
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	terminal bool
+}
+
+// newIPTrie builds a trie from CIDRs. Plain addresses are accepted as
+// single-host ranges.
+func newIPTrie(cidrs []string) (*ipTrie, error) {
+	t := &ipTrie{v4: &ipTrieNode{}, v6: &ipTrieNode{}}
+	for _, cidr := range cidrs {
+		ipNet, err := parseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		t.insert(ipNet)
+	}
+	return t, nil
+}
+
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %q", cidr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR: %q", cidr)
+	}
+	return ipNet, nil
+}
+
+func (t *ipTrie) insert(ipNet *net.IPNet) {
+	ones, _ := ipNet.Mask.Size()
+	node, ip := t.v6, ipNet.IP.To16()
+	if ip4 := ipNet.IP.To4(); ip4 != nil && len(ipNet.Mask) == net.IPv4len {
+		node, ip = t.v4, ip4
+	}
+	for i := 0; i < ones; i++ {
+		if node.terminal {
+			return
+		}
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &ipTrieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.terminal = true
+}
+
+func (t *ipTrie) contains(ip net.IP) bool {
+	if t == nil || ip == nil {
+		return false
+	}
+	node := t.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		node, ip = t.v4, ip4
+	} else {
+		ip = ip.To16()
+	}
+	for i := 0; node != nil; i++ {
+		if node.terminal {
+			return true
+		}
+		if i >= len(ip)*8 {
+			return false
+		}
+		node = node.children[(ip[i/8]>>(7-uint(i%8)))&1]
+	}
+	return false
+}
+
+// clientIP returns the address of the client that sent the request. Forwarding
+// headers are only honoured when the direct peer is a trusted proxy; the
+// X-Forwarded-For chain is then walked from right to left, skipping trusted
+// hops, so a client cannot spoof its address by prepending entries. When every
+// hop is trusted the leftmost one is the client.
+func (mk *Marker) clientIP(req *http.Request) net.IP {
+	remote := parseHostIP(req.RemoteAddr)
+	if remote == nil || !mk.trustedProxies.contains(remote) {
+		return remote
+	}
+
+	if forwarded := req.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		var leftmost net.IP
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				leftmost = nil
+				break
+			}
+			if !mk.trustedProxies.contains(ip) {
+				return ip
+			}
+			leftmost = ip
+		}
+		if leftmost != nil {
+			return leftmost
+		}
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(req.Header.Get("X-Real-IP"))); ip != nil {
+		return ip
+	}
+	return remote
+}
+
+func parseHostIP(addr string) net.IP {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.ParseIP(host)
+}
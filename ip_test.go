@@ -0,0 +1,129 @@
+package request_marker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIPTrie_Contains(t *testing.T) {
+	trie, err := newIPTrie([]string{"10.0.0.0/8", "192.168.1.0/24", "203.0.113.7", "2001:db8::/32"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		ip       string
+		expected bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"192.168.1.200", true},
+		{"192.168.2.1", false},
+		{"203.0.113.7", true},
+		{"203.0.113.8", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+		{"::ffff:10.0.0.1", true},
+	}
+
+	for _, tt := range tests {
+		if got := trie.contains(net.ParseIP(tt.ip)); got != tt.expected {
+			t.Errorf("contains(%s) = %v, expected %v", tt.ip, got, tt.expected)
+		}
+	}
+}
+
+func TestNewIPTrie_Invalid(t *testing.T) {
+	if _, err := newIPTrie([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("expected error for invalid CIDR")
+	}
+	if _, err := newIPTrie([]string{"not-an-ip"}); err == nil {
+		t.Errorf("expected error for invalid IP")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := newIPTrie([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	marker := &Marker{logger: NewLogger("DEBUG"), trustedProxies: proxies}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		expected   string
+	}{
+		{"direct client", "198.51.100.1:1234", "", "", "198.51.100.1"},
+		{"untrusted peer ignores headers", "198.51.100.1:1234", "1.2.3.4", "5.6.7.8", "198.51.100.1"},
+		{"trusted proxy uses forwarded for", "10.0.0.1:1234", "1.2.3.4", "", "1.2.3.4"},
+		{"skips trusted hops", "10.0.0.1:1234", "6.6.6.6, 1.2.3.4, 10.0.0.2", "", "1.2.3.4"},
+		{"falls back to real ip", "10.0.0.1:1234", "", "5.6.7.8", "5.6.7.8"},
+		{"all hops trusted", "10.0.0.1:1234", "10.0.0.2", "", "10.0.0.2"},
+		{"all hops trusted uses leftmost", "10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "5.6.7.8", "10.0.0.3"},
+		{"invalid hop falls back to real ip", "10.0.0.1:1234", "bogus, 10.0.0.2", "5.6.7.8", "5.6.7.8"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if tt.realIP != "" {
+			req.Header.Set("X-Real-IP", tt.realIP)
+		}
+
+		if got := marker.clientIP(req); got.String() != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestMarkerServeHTTP_IPRule(t *testing.T) {
+	config := &Config{
+		Tag:            "api",
+		LogLevel:       "DEBUG",
+		MarkerKey:      "X-MARK",
+		TrustedProxies: []string{"10.0.0.0/8"},
+		StaticRules: []Rule{
+			{
+				Tag:         "api",
+				Name:        "office",
+				Enable:      true,
+				Priority:    100,
+				Type:        RuleTypeIP,
+				MarkerValue: "office",
+				CIDRs:       []string{"203.0.113.0/24"},
+			},
+		},
+	}
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.1.1.1:5555"
+	req.Header.Set("X-Forwarded-For", "203.0.113.20")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if req.Header.Get("X-MARK") != "office" {
+		t.Errorf("expected X-MARK=office, got %s", req.Header.Get("X-MARK"))
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "198.51.100.1:5555"
+	req.Header.Set("X-Forwarded-For", "203.0.113.20")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if req.Header.Get("X-MARK") != "" {
+		t.Errorf("expected spoofed X-Forwarded-For to be ignored, got %s", req.Header.Get("X-MARK"))
+	}
+}
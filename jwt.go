@@ -0,0 +1,263 @@
+package request_marker
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultJWTHeader = "Authorization"
+	defaultJWTClaim  = "sub"
+)
+
+type jwtClaimsKey struct{}
+
+// jwtVerifier decodes bearer tokens and, when an algorithm is configured,
+// verifies their signature against a locally configured key.
+type jwtVerifier struct {
+	header    string
+	claim     string
+	algorithm string
+	secret    []byte
+	publicKey *rsa.PublicKey
+}
+
+func newJWTVerifier(config JWTConfig) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		header:    config.Header,
+		claim:     config.Claim,
+		algorithm: strings.ToUpper(config.Algorithm),
+	}
+	if v.header == "" {
+		v.header = defaultJWTHeader
+	}
+	if v.claim == "" {
+		v.claim = defaultJWTClaim
+	}
+
+	switch v.algorithm {
+	case "":
+	case "HS256":
+		if config.Secret == "" {
+			return nil, fmt.Errorf("jwt algorithm HS256 requires secret")
+		}
+		v.secret = []byte(config.Secret)
+	case "RS256":
+		key, err := parseRSAPublicKey(config.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		v.publicKey = key
+	default:
+		return nil, fmt.Errorf("unsupported jwt algorithm: %s", config.Algorithm)
+	}
+	return v, nil
+}
+
+func parseRSAPublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("jwt algorithm RS256 requires a PEM encoded publicKey")
+	}
+
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+		return nil, fmt.Errorf("jwt publicKey is not an RSA key")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+		if rsaKey, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+		return nil, fmt.Errorf("jwt certificate does not carry an RSA key")
+	}
+	return nil, fmt.Errorf("invalid jwt publicKey")
+}
+
+// parse extracts the token from the request and returns its claims.
+func (v *jwtVerifier) parse(req *http.Request) (map[string]interface{}, error) {
+	token := strings.TrimSpace(req.Header.Get(v.header))
+	if token == "" {
+		return nil, fmt.Errorf("jwt not found in header %s", v.header)
+	}
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed jwt")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid jwt header: %w", err)
+	}
+
+	if v.algorithm != "" {
+		if header.Alg != v.algorithm {
+			return nil, fmt.Errorf("unexpected jwt algorithm: %s", header.Alg)
+		}
+		signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwt signature encoding: %w", err)
+		}
+		if err := v.verify(parts[0]+"."+parts[1], signature); err != nil {
+			return nil, err
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid jwt payload: %w", err)
+	}
+
+	// Expiry is only enforced for verified tokens; unverified claims are
+	// untrusted anyway.
+	if v.algorithm != "" {
+		now := time.Now().Unix()
+		if exp, ok := numericClaim(claims["exp"]); ok && now >= exp {
+			return nil, fmt.Errorf("jwt expired")
+		}
+		if nbf, ok := numericClaim(claims["nbf"]); ok && now < nbf {
+			return nil, fmt.Errorf("jwt not valid yet")
+		}
+	}
+	return claims, nil
+}
+
+func (v *jwtVerifier) verify(signed string, signature []byte) error {
+	switch v.algorithm {
+	case "HS256":
+		mac := hmac.New(sha256.New, v.secret)
+		_, _ = mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("invalid jwt signature")
+		}
+	case "RS256":
+		digest := sha256.Sum256([]byte(signed))
+		if err := rsa.VerifyPKCS1v15(v.publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("invalid jwt signature")
+		}
+	}
+	return nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func numericClaim(value interface{}) (int64, bool) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	if i, err := number.Int64(); err == nil {
+		return i, true
+	}
+	f, err := number.Float64()
+	if err != nil {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// lookupClaim resolves a dot-separated claim path such as "org.id".
+func lookupClaim(claims map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// claimString renders a claim value for matching. Arrays and objects are
+// matched against their JSON encoding.
+func claimString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// withClaims parses the token once per request and keeps the claims on the
+// request context for identity extraction and claim rules.
+func (mk *Marker) withClaims(req *http.Request) *http.Request {
+	if mk.jwt == nil {
+		return req
+	}
+	claims, err := mk.jwt.parse(req)
+	if err != nil {
+		mk.logger.Debug(fmt.Sprintf("JWT not used: %v", err))
+	}
+	return req.WithContext(context.WithValue(req.Context(), jwtClaimsKey{}, claims))
+}
+
+func (mk *Marker) jwtClaims(req *http.Request) map[string]interface{} {
+	if mk.jwt == nil {
+		return nil
+	}
+	// A nil map is stored for requests whose token was rejected
+	if claims, ok := req.Context().Value(jwtClaimsKey{}).(map[string]interface{}); ok {
+		return claims
+	}
+	claims, err := mk.jwt.parse(req)
+	if err != nil {
+		return nil
+	}
+	return claims
+}
+
+func (mk *Marker) extractClaim(path string, req *http.Request) (string, bool) {
+	claims := mk.jwtClaims(req)
+	if claims == nil {
+		return "", false
+	}
+	value, ok := lookupClaim(claims, path)
+	if !ok {
+		return "", false
+	}
+	return claimString(value), true
+}
@@ -0,0 +1,195 @@
+package request_marker
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func signJWT(t *testing.T, alg string, claims map[string]interface{}, key interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case "RS256":
+		digest := sha256.Sum256([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerifier_Parse(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	claims := map[string]interface{}{"sub": "user001"}
+	expired := map[string]interface{}{"sub": "user001", "exp": time.Now().Add(-time.Minute).Unix()}
+
+	tests := []struct {
+		name    string
+		config  JWTConfig
+		token   string
+		wantErr bool
+	}{
+		{"decode only", JWTConfig{}, signJWT(t, "HS256", claims, []byte("other")), false},
+		{"hs256 valid", JWTConfig{Algorithm: "HS256", Secret: "secret"}, signJWT(t, "HS256", claims, []byte("secret")), false},
+		{"hs256 wrong secret", JWTConfig{Algorithm: "HS256", Secret: "secret"}, signJWT(t, "HS256", claims, []byte("other")), true},
+		{"hs256 expired", JWTConfig{Algorithm: "HS256", Secret: "secret"}, signJWT(t, "HS256", expired, []byte("secret")), true},
+		{"rs256 valid", JWTConfig{Algorithm: "RS256", PublicKey: publicKey}, signJWT(t, "RS256", claims, rsaKey), false},
+		{"algorithm mismatch", JWTConfig{Algorithm: "RS256", PublicKey: publicKey}, signJWT(t, "HS256", claims, []byte("secret")), true},
+		{"malformed", JWTConfig{}, "not-a-jwt", true},
+	}
+
+	for _, tt := range tests {
+		verifier, err := newJWTVerifier(tt.config)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tt.token)
+		got, err := verifier.parse(req)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+			continue
+		}
+		if err == nil && got["sub"] != "user001" {
+			t.Errorf("%s: expected sub user001, got %v", tt.name, got["sub"])
+		}
+	}
+}
+
+func TestNewJWTVerifier_Invalid(t *testing.T) {
+	tests := []JWTConfig{
+		{Algorithm: "HS256"},
+		{Algorithm: "RS256", PublicKey: "not a pem"},
+		{Algorithm: "ES256"},
+	}
+
+	for _, config := range tests {
+		if _, err := newJWTVerifier(config); err == nil {
+			t.Errorf("expected error for jwt config %+v", config)
+		}
+	}
+}
+
+func TestLookupClaim(t *testing.T) {
+	claims := map[string]interface{}{}
+	decodeJWTSegment(base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"u1","tier":"gold","org":{"id":12345678901234},"admin":true,"roles":["a","b"]}`)), &claims)
+
+	tests := []struct {
+		path    string
+		want    string
+		present bool
+	}{
+		{"sub", "u1", true},
+		{"org.id", "12345678901234", true},
+		{"admin", "true", true},
+		{"roles", `["a","b"]`, true},
+		{"org.name", "", false},
+		{"sub.id", "", false},
+	}
+
+	for _, tt := range tests {
+		value, ok := lookupClaim(claims, tt.path)
+		if ok != tt.present {
+			t.Errorf("%s: expected present %v, got %v", tt.path, tt.present, ok)
+			continue
+		}
+		if ok && claimString(value) != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.path, tt.want, claimString(value))
+		}
+	}
+}
+
+func TestMarkerServeHTTP_JWT(t *testing.T) {
+	config := &Config{
+		Tag:            "api",
+		LogLevel:       "DEBUG",
+		MarkerKey:      "X-MARK",
+		IdentifyHeader: "X-User-ID",
+		JWT:            JWTConfig{Enable: true, Algorithm: "HS256", Secret: "secret"},
+		StaticRules: []Rule{
+			{
+				Tag:         "api",
+				Name:        "gold-tier",
+				Enable:      true,
+				Priority:    200,
+				Type:        RuleTypeClaim,
+				MarkerValue: "gold",
+				Key:         "tier",
+				Operator:    MatchOperatorIn,
+				Values:      []string{"gold", "platinum"},
+			},
+			{
+				Tag:         "api",
+				Name:        "beta-users",
+				Enable:      true,
+				Priority:    100,
+				Type:        RuleTypeIdentify,
+				MarkerValue: "beta",
+				UserIds:     []string{"user001"},
+			},
+		},
+	}
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		header   string
+		expected string
+	}{
+		{"claim rule", signJWT(t, "HS256", map[string]interface{}{"sub": "user002", "tier": "gold"}, []byte("secret")), "", "gold"},
+		{"identity from sub", signJWT(t, "HS256", map[string]interface{}{"sub": "user001", "tier": "free"}, []byte("secret")), "", "beta"},
+		{"jwt wins over header", signJWT(t, "HS256", map[string]interface{}{"sub": "user002"}, []byte("secret")), "user001", ""},
+		{"forged token ignored", signJWT(t, "HS256", map[string]interface{}{"sub": "user001", "tier": "gold"}, []byte("forged")), "", ""},
+		{"header without token", "", "user001", "beta"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		if tt.header != "" {
+			req.Header.Set("X-User-ID", tt.header)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if req.Header.Get("X-MARK") != tt.expected {
+			t.Errorf("%s: expected X-MARK=%q, got %q", tt.name, tt.expected, req.Header.Get("X-MARK"))
+		}
+	}
+}
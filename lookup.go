@@ -0,0 +1,203 @@
+package request_marker
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"github.com/qxsugar/request-marker/redis"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLookupTimeout   = 50 * time.Millisecond
+	defaultLookupCacheSize = 10000
+	defaultLookupCacheTTL  = 30 * time.Second
+	lookupFailureWindow    = 5 * time.Second
+)
+
+// lookupCache is a small LRU of SISMEMBER results. Both positive and negative
+// answers are cached until they expire.
+type lookupCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lookupEntry struct {
+	key     string
+	member  bool
+	expires time.Time
+}
+
+func newLookupCache(size int, ttl time.Duration) *lookupCache {
+	return &lookupCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+func (c *lookupCache) get(key string, now time.Time) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return false, false
+	}
+	entry := elem.Value.(*lookupEntry)
+	if !now.Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return false, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.member, true
+}
+
+func (c *lookupCache) set(key string, member bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*lookupEntry)
+		entry.member, entry.expires = member, now.Add(c.ttl)
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&lookupEntry{key: key, member: member, expires: now.Add(c.ttl)})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lookupEntry).key)
+	}
+}
+
+// lookupBreaker stops live lookups of a set for a short window after one
+// failed, so that an unreachable Redis neither adds the lookup timeout to every
+// request nor logs an error for each of them.
+type lookupBreaker struct {
+	mu      sync.Mutex
+	window  time.Duration
+	open    map[string]time.Time // set key -> 恢复查询的时间
+	skipped map[string]int       // set key -> 窗口内跳过的查询数
+}
+
+func newLookupBreaker(window time.Duration) *lookupBreaker {
+	return &lookupBreaker{
+		window:  window,
+		open:    make(map[string]time.Time),
+		skipped: make(map[string]int),
+	}
+}
+
+// allow reports whether key may be looked up, counting the lookups skipped
+// while its window is open.
+func (b *lookupBreaker) allow(key string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if until, ok := b.open[key]; ok && now.Before(until) {
+		b.skipped[key]++
+		return false
+	}
+	return true
+}
+
+// fail opens the window of key and returns the number of lookups skipped since
+// the previous failure.
+func (b *lookupBreaker) fail(key string, now time.Time) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.open[key] = now.Add(b.window)
+	skipped := b.skipped[key]
+	delete(b.skipped, key)
+	return skipped
+}
+
+func (b *lookupBreaker) succeed(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.open, key)
+	delete(b.skipped, key)
+}
+
+func newLookupCacheFromConfig(config RedisConfig) *lookupCache {
+	size := config.LookupCacheSize
+	if size <= 0 {
+		size = defaultLookupCacheSize
+	}
+	ttl := time.Duration(config.LookupCacheTTL) * time.Second
+	if ttl <= 0 {
+		ttl = defaultLookupCacheTTL
+	}
+	return newLookupCache(size, ttl)
+}
+
+func lookupTimeout(config RedisConfig) time.Duration {
+	if config.LookupTimeout <= 0 {
+		return defaultLookupTimeout
+	}
+	return time.Duration(config.LookupTimeout) * time.Millisecond
+}
+
+// isMember checks set membership with SISMEMBER. Borrowing a connection and
+// running the command share one timeout; on failure the rule's FailOpen
+// decides the answer and nothing is cached. After a failure the set is not
+// looked up again for lookupFailureWindow, and the error is logged once per
+// window.
+func (mk *Marker) isMember(rule Rule, identify string) bool {
+	cacheKey := rule.UserIdsKey + "\x00" + identify
+	now := time.Now()
+	if mk.lookupCache != nil {
+		if member, ok := mk.lookupCache.get(cacheKey, now); ok {
+			return member
+		}
+	}
+	if mk.lookupBreaker != nil && !mk.lookupBreaker.allow(rule.UserIdsKey, now) {
+		return rule.FailOpen
+	}
+
+	member, err := mk.sismember(rule.UserIdsKey, identify)
+	if err != nil {
+		skipped := 0
+		if mk.lookupBreaker != nil {
+			skipped = mk.lookupBreaker.fail(rule.UserIdsKey, time.Now())
+		}
+		mk.logger.Error(fmt.Sprintf("Failed to look up user in %s for rule %s (failOpen=%t, %d lookups skipped since the last failure): %v",
+			rule.UserIdsKey, rule.Name, rule.FailOpen, skipped, err))
+		return rule.FailOpen
+	}
+	if mk.lookupBreaker != nil {
+		mk.lookupBreaker.succeed(rule.UserIdsKey)
+	}
+
+	if mk.lookupCache != nil {
+		mk.lookupCache.set(cacheKey, member, now)
+	}
+	return member
+}
+
+func (mk *Marker) sismember(key, identify string) (bool, error) {
+	if mk.lookupPool == nil {
+		return false, fmt.Errorf("redis is not configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout(mk.config.RedisConfig))
+	defer cancel()
+
+	conn, err := mk.lookupPool.GetContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	return redis.Bool(redis.DoContext(conn, ctx, "SISMEMBER", key, identify))
+}
@@ -0,0 +1,194 @@
+package request_marker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/qxsugar/request-marker/redis"
+)
+
+func TestLookupCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newLookupCache(2, time.Minute)
+	now := time.Now()
+
+	cache.set("a", true, now)
+	cache.set("b", false, now)
+	cache.get("a", now)
+	cache.set("c", true, now)
+
+	if _, ok := cache.get("b", now); ok {
+		t.Errorf("expected b to be evicted")
+	}
+	if member, ok := cache.get("a", now); !ok || !member {
+		t.Errorf("expected a to stay cached as member")
+	}
+	if member, ok := cache.get("c", now); !ok || !member {
+		t.Errorf("expected c to be cached as member")
+	}
+}
+
+func TestLookupCache_Expires(t *testing.T) {
+	cache := newLookupCache(10, time.Second)
+	now := time.Now()
+
+	cache.set("a", false, now)
+	if member, ok := cache.get("a", now.Add(500*time.Millisecond)); !ok || member {
+		t.Errorf("expected cached negative result")
+	}
+	if _, ok := cache.get("a", now.Add(time.Second)); ok {
+		t.Errorf("expected entry to expire after ttl")
+	}
+}
+
+func newLookupMarker(conn *fakeRedisConn, timeout int64) *Marker {
+	config := &Config{
+		MarkerKey:      "X-MARK",
+		IdentifyHeader: "X-User-ID",
+		RedisConfig:    RedisConfig{LookupTimeout: timeout},
+	}
+	marker := &Marker{
+		next:          http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		logger:        NewLogger("DEBUG"),
+		config:        config,
+		lookupCache:   newLookupCacheFromConfig(config.RedisConfig),
+		lookupBreaker: newLookupBreaker(lookupFailureWindow),
+	}
+	if conn != nil {
+		marker.lookupPool = &redis.Pool{Dial: func() (redis.Conn, error) { return conn, nil }}
+	}
+	return marker
+}
+
+func TestMatchByIdentify_LiveLookup(t *testing.T) {
+	conn := &fakeRedisConn{sets: map[string][]string{"whitelist": {"u1"}}}
+	marker := newLookupMarker(conn, 0)
+	rule := Rule{Name: "whitelist", Type: RuleTypeIdentify, UserIds: []string{"inline"}, UserIdsKey: "whitelist", UserIdsLookup: UserIdsLookupLive}
+
+	tests := []struct {
+		userID   string
+		expected bool
+	}{
+		{"inline", true},
+		{"u1", true},
+		{"u2", false},
+		{"u1", true},
+		{"u2", false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User-ID", tt.userID)
+		matched, err := marker.matchByIdentify(rule, req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if matched != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.userID, tt.expected, matched)
+		}
+	}
+
+	// Repeated lookups for u1 and u2 are served from the local cache
+	if conn.calls != 2 {
+		t.Errorf("expected 2 SISMEMBER calls, got %d", conn.calls)
+	}
+}
+
+func TestMatchByIdentify_LiveLookupFailure(t *testing.T) {
+	slow := &fakeRedisConn{sets: map[string][]string{"whitelist": {"u1"}}, delay: 200 * time.Millisecond}
+
+	tests := []struct {
+		name     string
+		marker   *Marker
+		failOpen bool
+	}{
+		{"timeout fail closed", newLookupMarker(slow, 10), false},
+		{"timeout fail open", newLookupMarker(slow, 10), true},
+		{"no redis fail closed", newLookupMarker(nil, 0), false},
+		{"no redis fail open", newLookupMarker(nil, 0), true},
+	}
+
+	for _, tt := range tests {
+		rule := Rule{Name: "whitelist", Type: RuleTypeIdentify, UserIdsKey: "whitelist", UserIdsLookup: UserIdsLookupLive, FailOpen: tt.failOpen}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User-ID", "u2")
+
+		start := time.Now()
+		matched, _ := tt.marker.matchByIdentify(rule, req)
+		if matched != tt.failOpen {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.failOpen, matched)
+		}
+		if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+			t.Errorf("%s: lookup took %v despite the timeout", tt.name, elapsed)
+		}
+	}
+}
+
+func TestMatchByIdentify_LiveLookupBudget(t *testing.T) {
+	marker := newLookupMarker(nil, 50)
+
+	// A half-dead Redis: dialing would take seconds
+	dials := 0
+	marker.lookupPool = newLookupPool(marker.config.RedisConfig)
+	marker.lookupPool.DialContext = func(ctx context.Context) (redis.Conn, error) {
+		dials++
+		select {
+		case <-time.After(5 * time.Second):
+			return &fakeRedisConn{}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if marker.lookupPool.TestOnBorrow != nil {
+		t.Fatalf("expected the lookup pool not to ping on borrow, which ignores the lookup timeout")
+	}
+
+	rule := Rule{Name: "whitelist", Type: RuleTypeIdentify, UserIdsKey: "whitelist", UserIdsLookup: UserIdsLookupLive, FailOpen: true}
+	for _, userID := range []string{"u1", "u2", "u3"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User-ID", userID)
+
+		start := time.Now()
+		matched, _ := marker.matchByIdentify(rule, req)
+		if !matched {
+			t.Errorf("%s: expected failOpen to match", userID)
+		}
+		if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+			t.Errorf("%s: lookup took %v despite the 50ms timeout", userID, elapsed)
+		}
+	}
+
+	// Lookups after the first failure skip Redis until the window closes
+	if dials != 1 {
+		t.Errorf("expected 1 dial while the failure window is open, got %d", dials)
+	}
+}
+
+func TestLookupBreaker(t *testing.T) {
+	breaker := newLookupBreaker(5 * time.Second)
+	now := time.Now()
+
+	if !breaker.allow("a", now) {
+		t.Fatalf("expected lookups to be allowed before any failure")
+	}
+	breaker.fail("a", now)
+	if breaker.allow("a", now.Add(time.Second)) || breaker.allow("a", now.Add(2*time.Second)) {
+		t.Errorf("expected lookups to be skipped inside the failure window")
+	}
+	if !breaker.allow("b", now.Add(time.Second)) {
+		t.Errorf("expected other sets to stay unaffected")
+	}
+	if !breaker.allow("a", now.Add(5*time.Second)) {
+		t.Errorf("expected lookups to resume after the window")
+	}
+	if skipped := breaker.fail("a", now.Add(5*time.Second)); skipped != 2 {
+		t.Errorf("expected 2 skipped lookups to be reported, got %d", skipped)
+	}
+
+	breaker.succeed("a")
+	if !breaker.allow("a", now.Add(6*time.Second)) {
+		t.Errorf("expected a success to close the window")
+	}
+}
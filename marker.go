@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"github.com/qxsugar/request-marker/redis"
 	"hash/fnv"
+	"net"
 	"net/http"
+	"path"
+	"regexp"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,11 +20,22 @@ func CreateConfig() *Config {
 }
 
 type Marker struct {
-	next      http.Handler
-	redisConn redis.Conn
-	logger    *Logger
-	config    *Config
-	mu        sync.RWMutex
+	next             http.Handler
+	redisPool        *redis.Pool
+	lookupPool       *redis.Pool
+	lookupCache      *lookupCache
+	lookupBreaker    *lookupBreaker
+	snapshot         ruleSnapshot
+	logger           *Logger
+	config           *Config
+	trustedProxies   *ipTrie
+	versionPattern   *regexp.Regexp
+	platformPatterns []platformPattern
+	jwt              *jwtVerifier
+	identifySources  []identifySource
+	source           ruleSource
+	clock            func() time.Time
+	mu               sync.RWMutex
 }
 
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
@@ -32,6 +45,10 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 	if config.RedisConfig.Enable {
 		logger.Info(fmt.Sprintf("Redis config: Addr=%s, DB=%d, RuleListKeys=%s, RefreshInterval=%ds",
 			config.RedisConfig.Addr, config.RedisConfig.DB, config.RedisConfig.RuleListKeys, config.RedisConfig.RefreshInterval))
+	} else if config.FileConfig.Enable {
+		logger.Info(fmt.Sprintf("File config: Path=%s, RefreshInterval=%ds", config.FileConfig.Path, config.FileConfig.RefreshInterval))
+	} else if config.HTTPConfig.Enable {
+		logger.Info(fmt.Sprintf("HTTP config: URL=%s, RefreshInterval=%ds", config.HTTPConfig.URL, config.HTTPConfig.RefreshInterval))
 	} else {
 		logger.Info("Redis dynamic rule loading is disabled")
 	}
@@ -42,26 +59,111 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		logger: logger,
 	}
 
+	if err := validateRuleSources(config); err != nil {
+		logger.Error(err.Error())
+		return nil, fmt.Errorf("invalid rule source configuration: %w", err)
+	}
+
+	if err := validateIdentifyFallbacks(config); err != nil {
+		logger.Error(err.Error())
+		return nil, fmt.Errorf("invalid identifyFallbacks configuration: %w", err)
+	}
+
+	if err := validateVisitorCookie(config.VisitorCookie); err != nil {
+		logger.Error(err.Error())
+		return nil, fmt.Errorf("invalid visitorCookie configuration: %w", err)
+	}
+
+	if config.JWT.Enable {
+		verifier, err := newJWTVerifier(config.JWT)
+		if err != nil {
+			logger.Error(err.Error())
+			return nil, fmt.Errorf("invalid jwt configuration: %w", err)
+		}
+		marker.jwt = verifier
+	}
+
+	if len(config.IdentifySources) > 0 {
+		identifySources, err := compileIdentifySources(config.IdentifySources, marker.jwt != nil)
+		if err != nil {
+			logger.Error(err.Error())
+			return nil, fmt.Errorf("invalid identifySources configuration: %w", err)
+		}
+		marker.identifySources = identifySources
+	} else {
+		marker.identifySources = legacyIdentifySources(config, marker.jwt != nil)
+	}
+
+	if len(config.TrustedProxies) > 0 {
+		trustedProxies, err := newIPTrie(config.TrustedProxies)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Invalid trusted proxies: %v", err))
+			return nil, fmt.Errorf("invalid trustedProxies configuration: %w", err)
+		}
+		marker.trustedProxies = trustedProxies
+	}
+
+	if config.VersionPattern != "" {
+		versionPattern, err := compileVersionPattern(config.VersionPattern)
+		if err != nil {
+			logger.Error(err.Error())
+			return nil, fmt.Errorf("invalid versionPattern configuration: %w", err)
+		}
+		marker.versionPattern = versionPattern
+	}
+
+	platformPatterns, err := compilePlatformPatterns(config.PlatformPatterns)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, fmt.Errorf("invalid platformPatterns configuration: %w", err)
+	}
+	marker.platformPatterns = platformPatterns
+
 	// Validate and sort static rules by priority (highest first)
 	if config.StaticRules != nil && len(config.StaticRules) > 0 {
-		for i, rule := range config.StaticRules {
-			if err := rule.Validate(); err != nil {
+		for i := range config.StaticRules {
+			if err := config.StaticRules[i].Validate(); err != nil {
+				logger.Error(fmt.Sprintf("Invalid static rule at index %d: %v", i, err))
+				return nil, fmt.Errorf("invalid rule configuration: %w", err)
+			}
+			if err := validateStaticCohorts(&config.StaticRules[i], config.RedisConfig.Enable); err != nil {
+				logger.Error(fmt.Sprintf("Invalid static rule at index %d: %v", i, err))
+				return nil, fmt.Errorf("invalid rule configuration: %w", err)
+			}
+			if err := config.StaticRules[i].compile(); err != nil {
 				logger.Error(fmt.Sprintf("Invalid static rule at index %d: %v", i, err))
 				return nil, fmt.Errorf("invalid rule configuration: %w", err)
 			}
 		}
 		sort.Sort(SortByPriority(config.StaticRules))
 	}
+	marker.snapshot = ruleSnapshot{version: rulesVersion(config.StaticRules), source: ruleSourceStatic, loadedAt: time.Now()}
+
+	if config.RedisConfig.Enable {
+		marker.redisPool = newRedisPool(config.RedisConfig)
+		marker.lookupPool = newLookupPool(config.RedisConfig)
+		marker.lookupCache = newLookupCacheFromConfig(config.RedisConfig)
+		marker.lookupBreaker = newLookupBreaker(lookupFailureWindow)
+	}
 
 	marker.startRefreshConfig(ctx)
 	return marker, nil
 }
 
 func (mk *Marker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req = mk.withClaims(req)
+	req = mk.assignVisitor(w, req)
+
 	mk.mu.RLock()
 	rules := mk.config.StaticRules
+	snapshot := mk.snapshot
 	mk.mu.RUnlock()
 
+	now := mk.now()
+	if header := mk.config.SnapshotPolicy.Header; header != "" {
+		req.Header.Set(header, mk.snapshotHeaderValue(snapshot, now))
+	}
+
 	if len(rules) <= 0 {
 		mk.next.ServeHTTP(w, req)
 		return
@@ -72,28 +174,21 @@ func (mk *Marker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			continue
 		}
 
-		if rule.Tag != mk.config.Tag {
+		if !rule.activeAt(now) {
+			continue
+		}
+
+		if !rule.hasTag(mk.config.Tag) {
 			continue
 		}
 
 		var markKey, markValue string
-		switch rule.Type {
-		case RuleTypePath:
-			if matched, err := mk.matchByURI(rule, req); matched && err == nil {
-				markKey, markValue = mk.config.MarkerKey, rule.MarkerValue
-			}
-		case RuleTypeCanary:
-			if matched, err := mk.matchByWeight(rule, req); matched && err == nil {
-				markKey, markValue = mk.config.MarkerKey, rule.MarkerValue
-			}
-		case RuleTypeIdentify:
-			if matched, err := mk.matchByIdentify(rule, req); matched && err == nil {
-				markKey, markValue = mk.config.MarkerKey, rule.MarkerValue
-			}
-		case RuleTypeVersion:
-			if matched, err := mk.matchByVersion(rule, req); matched && err == nil {
-				markKey, markValue = mk.config.MarkerKey, rule.MarkerValue
+		if rule.Type == RuleTypeSplit {
+			if variant, err := mk.selectVariant(rule, req); variant != "" && err == nil {
+				markKey, markValue = mk.config.MarkerKey, variant
 			}
+		} else if matched, err := mk.matchRule(rule, req); matched && err == nil {
+			markKey, markValue = mk.config.MarkerKey, rule.MarkerValue
 		}
 
 		if markKey != "" && markValue != "" {
@@ -107,91 +202,250 @@ func (mk *Marker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	mk.next.ServeHTTP(w, req)
 }
 
-func (mk *Marker) startRefreshConfig(ctx context.Context) {
-	if !mk.config.RedisConfig.Enable {
-		mk.logger.Info("Redis dynamic rule loading is disabled, skipping refresh configuration")
-		return
+func (mk *Marker) matchRule(rule Rule, req *http.Request) (bool, error) {
+	if !matchMethod(rule.Methods, req) || !matchHost(rule.Hosts, req) {
+		return false, nil
 	}
-	conn, err := NewRedis(mk.config.RedisConfig.Addr, mk.config.RedisConfig.Password, mk.config.RedisConfig.DB)
-	if err != nil {
-		mk.logger.Error(fmt.Sprintf("Failed to connect to Redis: %v", err))
-		return
+
+	switch rule.Type {
+	case RuleTypePath:
+		return mk.matchByURI(rule, req)
+	case RuleTypeCanary:
+		return mk.matchByWeight(rule, req)
+	case RuleTypeIdentify:
+		return mk.matchByIdentify(rule, req)
+	case RuleTypeVersion:
+		return mk.matchByVersion(rule, req)
+	case RuleTypeHeader, RuleTypeCookie, RuleTypeQuery, RuleTypeClaim:
+		return mk.matchByAttribute(rule, req)
+	case RuleTypeIP:
+		return mk.matchByIP(rule, req)
+	case RuleTypeComposite:
+		if rule.Conditions == nil {
+			return false, fmt.Errorf("composite rule %s has no conditions", rule.Name)
+		}
+		return mk.matchCondition(*rule.Conditions, req)
 	}
+	return false, fmt.Errorf("unknown rule type: %s", rule.Type)
+}
 
-	mk.redisConn = conn
+func matchMethod(methods []string, req *http.Request) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, method := range methods {
+		if strings.EqualFold(strings.TrimSpace(method), req.Method) {
+			return true
+		}
+	}
+	return false
+}
 
-	if err := mk.refreshConfig(); err != nil {
-		mk.logger.Error(fmt.Sprintf("Failed to load rules on startup: %v", err))
-		return
+// matchHost compares the request host without port against the patterns. A
+// "*.example.com" pattern matches any subdomain but not example.com itself.
+func matchHost(hosts []string, req *http.Request) bool {
+	if len(hosts) == 0 {
+		return true
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
 	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
 
-	go func() {
-		mk.logger.Info("Starting periodic rule refresh from Redis")
-		ticker := time.NewTicker(time.Duration(mk.config.RedisConfig.RefreshInterval) * time.Second)
-		defer ticker.Stop()
+	for _, pattern := range hosts {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
 
-		for {
-			select {
-			case <-ctx.Done():
-				mk.logger.Info("Stopping rule refresh goroutine")
-				return
-			case <-ticker.C:
-				if err := mk.refreshConfig(); err != nil {
-					mk.logger.Error(fmt.Sprintf("Failed to refresh rules from Redis: %v", err))
-				}
+// matchCondition evaluates a condition tree. Errors propagate upwards so that a
+// failing leaf never turns into a match through a "not" operator.
+func (mk *Marker) matchCondition(cond Condition, req *http.Request) (bool, error) {
+	switch {
+	case len(cond.All) > 0:
+		for _, sub := range cond.All {
+			matched, err := mk.matchCondition(sub, req)
+			if err != nil || !matched {
+				return false, err
 			}
 		}
-	}()
+		return true, nil
+	case len(cond.Any) > 0:
+		for _, sub := range cond.Any {
+			matched, err := mk.matchCondition(sub, req)
+			if err != nil {
+				return false, err
+			}
+			if matched {
+				return true, nil
+			}
+		}
+		return false, nil
+	case cond.Not != nil:
+		matched, err := mk.matchCondition(*cond.Not, req)
+		if err != nil {
+			return false, err
+		}
+		return !matched, nil
+	}
+	return mk.matchRule(cond.Rule, req)
 }
 
-func (mk *Marker) refreshConfig() error {
-	rulesListKey := mk.config.RedisConfig.RuleListKeys
+const (
+	defaultRefreshInterval = 15 * time.Second
+	minRetryBackoff        = time.Second
+	maxRetryBackoff        = time.Minute
+)
 
-	length, err := redis.Int(mk.redisConn.Do("LLEN", rulesListKey))
-	if err != nil {
-		return fmt.Errorf("failed to get rules list length: %w", err)
+func refreshInterval(seconds int64) time.Duration {
+	if seconds <= 0 {
+		return defaultRefreshInterval
 	}
+	return time.Duration(seconds) * time.Second
+}
 
-	if length <= 0 {
-		return fmt.Errorf("no rules found in Redis key: %s", rulesListKey)
+func (mk *Marker) startRefreshConfig(ctx context.Context) {
+	if !dynamicRulesEnabled(mk.config) {
+		mk.logger.Info("Redis dynamic rule loading is disabled, skipping refresh configuration")
+		return
 	}
+	if mk.config.RedisConfig.Enable && mk.redisPool == nil {
+		mk.redisPool = newRedisPool(mk.config.RedisConfig)
+	}
+	mk.source = mk.newRuleSource()
 
-	ruleKeys, err := redis.Strings(mk.redisConn.Do("LRANGE", rulesListKey, 0, length-1))
-	if err != nil {
-		return fmt.Errorf("failed to fetch rule keys from Redis: %w", err)
+	interval := mk.dynamicRefreshInterval()
+
+	failures := 0
+	if err := mk.refreshConfig(); err != nil {
+		mk.logger.Error(fmt.Sprintf("Failed to load rules on startup, retrying in background: %v", err))
+		failures = 1
 	}
 
-	rules := make([]Rule, 0, len(ruleKeys))
+	// Invalidation messages trigger an immediate refresh; the ticker stays as
+	// a safety net for missed messages.
+	var trigger chan struct{}
+	if channel := mk.config.RedisConfig.InvalidationChannel; mk.config.RedisConfig.Enable && channel != "" {
+		trigger = make(chan struct{}, 1)
+		go mk.watchInvalidations(ctx, channel, trigger)
+	}
 
-	for _, ruleKey := range ruleKeys {
-		values, err := redis.Values(mk.redisConn.Do("HGETALL", ruleKey))
-		if err != nil {
-			mk.logger.Error(fmt.Sprintf("Failed to fetch rule from Redis (key=%s): %v", ruleKey, err))
-			continue
-		}
+	go mk.refreshLoop(ctx, interval, failures, trigger)
+}
 
-		rule, err := parseRule(values)
-		if err != nil {
-			mk.logger.Error(fmt.Sprintf("Failed to parse rule (key=%s): %v", ruleKey, err))
-			continue
-		}
+// refreshLoop reloads rules every interval and whenever trigger fires. After a
+// failed load it retries with exponential backoff, and it keeps going until
+// ctx is done so that a restarted source or one unreachable at startup heals
+// by itself.
+func (mk *Marker) refreshLoop(ctx context.Context, interval time.Duration, failures int, trigger <-chan struct{}) {
+	mk.logger.Info("Starting periodic rule refresh")
 
-		if rule.Tag != mk.config.Tag {
-			continue
+	delay := interval
+	if failures > 0 {
+		delay = retryBackoff(failures, interval)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			mk.logger.Info("Stopping rule refresh goroutine")
+			for _, pool := range []*redis.Pool{mk.redisPool, mk.lookupPool} {
+				if pool == nil {
+					continue
+				}
+				if err := pool.Close(); err != nil {
+					mk.logger.Error(fmt.Sprintf("Failed to close Redis pool: %v", err))
+				}
+			}
+			return
+		case <-timer.C:
+		case <-trigger:
+			mk.logger.Debug("Refreshing rules on invalidation")
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
 		}
 
-		rules = append(rules, rule)
+		if err := mk.refreshConfig(); err != nil {
+			failures++
+			delay = retryBackoff(failures, interval)
+			mk.logger.Error(fmt.Sprintf("Failed to refresh rules (attempt %d, retrying in %s): %v", failures, delay, err))
+		} else {
+			if failures > 0 {
+				mk.logger.Info(fmt.Sprintf("Rule refresh recovered after %d failed attempts", failures))
+			}
+			failures = 0
+			delay = interval
+		}
+		timer.Reset(delay)
 	}
+}
 
-	sort.Sort(SortByPriority(rules))
-
-	mk.mu.Lock()
-	mk.config.StaticRules = rules
-	mk.mu.Unlock()
-
-	mk.logger.Debug(fmt.Sprintf("Loaded %d rules from Redis", len(rules)))
+// retryBackoff doubles the delay with every consecutive failure, starting at
+// minRetryBackoff and never exceeding maxRetryBackoff or the regular interval.
+func retryBackoff(failures int, interval time.Duration) time.Duration {
+	delay := minRetryBackoff
+	for i := 1; i < failures && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	if delay > interval {
+		delay = interval
+	}
+	return delay
+}
 
-	return nil
+// scanSet adds all members of a Redis SET to members with SSCAN, so that
+// large sets are fetched in batches instead of one blocking SMEMBERS call. It
+// returns a digest of the set that does not depend on the scan order; members
+// SSCAN returns more than once are only counted once.
+func scanSet(conn redis.Conn, key string, members map[string]struct{}) (uint64, error) {
+	var digest uint64
+	cursor := "0"
+	for {
+		reply, err := redis.Values(conn.Do("SSCAN", key, cursor, "COUNT", 1000))
+		if err != nil {
+			return 0, err
+		}
+		if len(reply) != 2 {
+			return 0, fmt.Errorf("unexpected SSCAN reply length %d", len(reply))
+		}
+		cursor, err = redis.String(reply[0], nil)
+		if err != nil {
+			return 0, err
+		}
+		batch, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return 0, err
+		}
+		for _, member := range batch {
+			if _, ok := members[member]; ok {
+				continue
+			}
+			members[member] = struct{}{}
+			h := fnv.New64a()
+			_, _ = h.Write([]byte(member))
+			digest += h.Sum64()
+		}
+		if cursor == "0" {
+			return digest, nil
+		}
+	}
 }
 
 func (mk *Marker) matchByIdentify(rule Rule, req *http.Request) (bool, error) {
@@ -200,94 +454,219 @@ func (mk *Marker) matchByIdentify(rule Rule, req *http.Request) (bool, error) {
 		return false, nil
 	}
 
-	for _, userID := range rule.UserIds {
-		if userID == identify {
-			return true, nil
-		}
+	if _, ok := rule.matchers().userIDs[identify]; ok {
+		return true, nil
+	}
+	if rule.UserIdsLookup == UserIdsLookupLive {
+		return mk.isMember(rule, identify), nil
 	}
-
 	return false, nil
 }
 
 func (mk *Marker) matchByURI(rule Rule, req *http.Request) (bool, error) {
-	if strings.Contains(req.URL.String(), rule.Path) {
-		return true, nil
+	reqPath := req.URL.Path
+	switch rule.PathMatch {
+	case PathMatchExact:
+		return reqPath == rule.Path, nil
+	case PathMatchGlob:
+		return path.Match(rule.Path, reqPath)
+	case PathMatchRegex:
+		re := rule.matchers().pathRegexp
+		if re == nil {
+			return false, fmt.Errorf("path regex of rule %s is not compiled", rule.Name)
+		}
+		return re.MatchString(reqPath), nil
+	default:
+		return hasPathPrefix(reqPath, rule.Path), nil
 	}
-	return false, nil
+}
+
+// hasPathPrefix reports whether p is prefix or below it, matching whole path
+// segments only: /admin matches /admin and /admin/users but not /administrator.
+func hasPathPrefix(p, prefix string) bool {
+	return p == prefix || strings.HasPrefix(p, strings.TrimSuffix(prefix, "/")+"/")
 }
 
 func (mk *Marker) matchByVersion(rule Rule, req *http.Request) (bool, error) {
-	requestVersion := req.Header.Get(mk.config.VersionHeader)
+	requestVersion := mk.extractVersion(req)
 	if requestVersion == "" {
 		return false, nil
 	}
-	if mk.compareVersion(requestVersion, rule.MinVersion) >= 0 && mk.compareVersion(rule.MaxVersion, requestVersion) >= 0 {
-		return true, nil
+	version, err := parseSemver(requestVersion)
+	if err != nil {
+		mk.logger.Debug(fmt.Sprintf("Ignoring unparsable request version %q: %v", requestVersion, err))
+		return false, nil
 	}
 
-	return false, nil
+	// A platform specific range takes precedence over the rule's generic range
+	matchers := rule.matchers()
+	versions := matchers.versions
+	if len(matchers.platforms) > 0 {
+		if platformVersions, ok := matchers.platforms[mk.detectPlatform(req)]; ok {
+			versions = platformVersions
+		}
+	}
+	if versions == nil {
+		return false, nil
+	}
+	return versions.matches(version), nil
 }
 
 func (mk *Marker) matchByWeight(rule Rule, req *http.Request) (bool, error) {
-	hashValue, err := mk.hashIdentify(req)
+	hashValue, err := mk.hashIdentify(req, rule.Salt)
 	if err != nil {
 		mk.logger.Debug(fmt.Sprintf("Failed to hash identify for weight matching: %v", err))
 		return false, nil
 	}
-	if hashValue%100 <= rule.Canary {
-		return true, nil
+
+	bucket := canaryBucket(hashValue)
+	if len(rule.Buckets) > 0 {
+		for _, r := range rule.Buckets {
+			if bucket >= r.From && bucket < r.To {
+				return true, nil
+			}
+		}
+		return false, nil
 	}
-	return false, nil
+
+	threshold := rule.Canary * canaryBuckets / 100
+	if rule.CanaryBps > 0 {
+		threshold = rule.CanaryBps
+	}
+	return bucket < threshold, nil
 }
 
-func (mk *Marker) compareVersion(version1, version2 string) int {
-	v1 := strings.Split(version1, ".")
-	v2 := strings.Split(version2, ".")
-	for i := 0; i < len(v1) || i < len(v2); i++ {
-		x, y := 0, 0
-		if i < len(v1) {
-			x, _ = strconv.Atoi(v1[i])
-		}
-		if i < len(v2) {
-			y, _ = strconv.Atoi(v2[i])
-		}
-		if x > y {
-			return 1
-		}
-		if x < y {
-			return -1
+// canaryBucket maps a hash to one of canaryBuckets buckets. The percentage
+// bucket hash%100 used by earlier releases is the leading part of the bucket,
+// so an unsalted canary of N percent keeps the users it admitted before.
+func canaryBucket(hashValue int) int {
+	return (hashValue%100)*100 + (hashValue/100)%100
+}
+
+// selectVariant deterministically assigns the request's identity to one of the
+// rule's variants in proportion to their weights. The rule's salt, or its name
+// when no salt is set, keeps different experiments independent of each other.
+func (mk *Marker) selectVariant(rule Rule, req *http.Request) (string, error) {
+	if !matchMethod(rule.Methods, req) || !matchHost(rule.Hosts, req) {
+		return "", nil
+	}
+
+	total := 0
+	for _, variant := range rule.Variants {
+		total += variant.Weight
+	}
+	if total <= 0 {
+		return "", fmt.Errorf("split rule %s has no weight", rule.Name)
+	}
+
+	salt := rule.Salt
+	if salt == "" {
+		salt = rule.Name
+	}
+	hashValue, err := mk.hashIdentify(req, salt)
+	if err != nil {
+		mk.logger.Debug(fmt.Sprintf("Failed to hash identify for split rule %s: %v", rule.Name, err))
+		return "", nil
+	}
+
+	point := hashValue % total
+	for _, variant := range rule.Variants {
+		if point < variant.Weight {
+			return variant.Value, nil
 		}
+		point -= variant.Weight
 	}
-	return 0
+	return "", nil
 }
 
-func (mk *Marker) hashIdentify(req *http.Request) (int, error) {
-	identify, err := mk.extractIdentify(req)
-	if err != nil {
-		return 0, err
+func (mk *Marker) matchByIP(rule Rule, req *http.Request) (bool, error) {
+	ip := mk.clientIP(req)
+	if ip == nil {
+		return false, nil
+	}
+	trie := rule.matchers().cidrs
+	if trie == nil {
+		return false, fmt.Errorf("cidrs of rule %s are not compiled", rule.Name)
 	}
+	return trie.contains(ip), nil
+}
 
-	h := fnv.New32a()
-	_, _ = h.Write([]byte(identify))
-	return int(h.Sum32()), nil
+func (mk *Marker) matchByAttribute(rule Rule, req *http.Request) (bool, error) {
+	value, present := mk.extractAttribute(rule.Type, rule.Key, req)
+	return matchOperator(rule, value, present)
 }
 
-func (mk *Marker) extractIdentify(req *http.Request) (string, error) {
-	// Priority: header -> cookie -> query parameter
-	identify := req.Header.Get(mk.config.IdentifyHeader)
-	if identify == "" {
-		cookie, err := req.Cookie(mk.config.IdentifyCookie)
-		if err == nil && cookie.Value != "" {
-			identify = cookie.Value
-		}
+// matchOperator applies the rule's operator to a value extracted from the
+// request. present reports whether the attribute was sent at all.
+func matchOperator(rule Rule, value string, present bool) (bool, error) {
+	switch rule.Operator {
+	case MatchOperatorExists:
+		return present, nil
+	case MatchOperatorAbsent:
+		return !present, nil
+	}
+	if !present {
+		return false, nil
 	}
-	if identify == "" {
-		identify = req.URL.Query().Get(mk.config.IdentifyQuery)
+
+	switch rule.Operator {
+	case "", MatchOperatorEquals:
+		return len(rule.Values) > 0 && value == rule.Values[0], nil
+	case MatchOperatorIn:
+		for _, v := range rule.Values {
+			if v == value {
+				return true, nil
+			}
+		}
+		return false, nil
+	case MatchOperatorRegex:
+		re := rule.matchers().valueRegexp
+		if re == nil {
+			return false, fmt.Errorf("value regex of rule %s is not compiled", rule.Name)
+		}
+		return re.MatchString(value), nil
 	}
+	return false, fmt.Errorf("unknown operator: %s", rule.Operator)
+}
 
-	if identify == "" {
-		return "", fmt.Errorf("identify not found in header, cookie, or query parameter")
+func (mk *Marker) extractAttribute(ruleType RuleType, key string, req *http.Request) (string, bool) {
+	switch ruleType {
+	case RuleTypeHeader:
+		values, ok := req.Header[http.CanonicalHeaderKey(key)]
+		if !ok || len(values) == 0 {
+			return "", false
+		}
+		return values[0], true
+	case RuleTypeCookie:
+		cookie, err := req.Cookie(key)
+		if err != nil {
+			return "", false
+		}
+		return cookie.Value, true
+	case RuleTypeQuery:
+		values, ok := req.URL.Query()[key]
+		if !ok || len(values) == 0 {
+			return "", false
+		}
+		return values[0], true
+	case RuleTypeClaim:
+		return mk.extractClaim(key, req)
 	}
+	return "", false
+}
 
-	return identify, nil
+// compareVersion compares two versions by SemVer precedence. Unparsable
+// versions sort before any valid version.
+func (mk *Marker) compareVersion(version1, version2 string) int {
+	v1, err1 := parseSemver(version1)
+	v2, err2 := parseSemver(version2)
+	switch {
+	case err1 != nil && err2 != nil:
+		return 0
+	case err1 != nil:
+		return -1
+	case err2 != nil:
+		return 1
+	}
+	return v1.compare(v2)
 }
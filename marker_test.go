@@ -2,10 +2,16 @@ package request_marker
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/qxsugar/request-marker/redis"
+	"hash/fnv"
 	"net/http"
 	"net/http/httptest"
 	"sort"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMarkerServeHTTP_IdentifyRule(t *testing.T) {
@@ -352,6 +358,11 @@ func TestCompareVersion(t *testing.T) {
 		{"2.0.0", "2.1.0", -1},
 		{"2.9.9", "2.0.0", 1},
 		{"1.0.0", "2.0.0", -1},
+		{"v2.1", "2.1.0", 0},
+		{"2.1.0-beta.1", "2.1.0", -1},
+		{"2.1.0+build.7", "2.1.0", 0},
+		{"2.10.0", "2.9.0", 1},
+		{"garbage", "0.0.1", -1},
 	}
 
 	for _, tt := range tests {
@@ -404,3 +415,831 @@ func TestNew_StaticRules(t *testing.T) {
 		t.Errorf("expected second rule priority 50, got %d", marker.config.StaticRules[1].Priority)
 	}
 }
+
+func TestMatchByURI_PathMatchModes(t *testing.T) {
+	marker := &Marker{logger: NewLogger("DEBUG")}
+
+	tests := []struct {
+		mode     PathMatch
+		pattern  string
+		target   string
+		expected bool
+	}{
+		{"", "/admin", "/admin/users", true},
+		{"", "/admin", "/api/v1/users?next=/admin", false},
+		{"", "/admin", "/admin", true},
+		{"", "/admin", "/administrator", false},
+		{"", "/admin", "/admin-legacy", false},
+		{"", "/admin/", "/admin/users", true},
+		{"", "/", "/anything", true},
+		{PathMatchPrefix, "/api", "/api/v1", true},
+		{PathMatchPrefix, "/api", "/apis", false},
+		{PathMatchExact, "/health", "/health", true},
+		{PathMatchExact, "/health", "/health/live", false},
+		{PathMatchGlob, "/api/*/orders", "/api/v2/orders", true},
+		{PathMatchGlob, "/api/*/orders", "/api/v2/x/orders", false},
+		{PathMatchRegex, "^/users/[0-9]+$", "/users/42", true},
+		{PathMatchRegex, "^/users/[0-9]+$", "/users/abc", false},
+	}
+
+	for _, tt := range tests {
+		rule := Rule{Name: "path", MarkerValue: "mark", Type: RuleTypePath, Path: tt.pattern, PathMatch: tt.mode}
+		if err := rule.compile(); err != nil {
+			t.Fatalf("unexpected compile error: %v", err)
+		}
+
+		req := httptest.NewRequest("GET", tt.target, nil)
+		matched, err := marker.matchByURI(rule, req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if matched != tt.expected {
+			t.Errorf("matchByURI(%s %q, %q) = %v, expected %v", tt.mode, tt.pattern, tt.target, matched, tt.expected)
+		}
+	}
+}
+
+func TestMarkerServeHTTP_CompositeRule(t *testing.T) {
+	config := &Config{
+		Tag:            "api",
+		LogLevel:       "DEBUG",
+		MarkerKey:      "X-MARK",
+		VersionHeader:  "X-Version",
+		IdentifyHeader: "X-User-ID",
+		StaticRules: []Rule{
+			{
+				Tag:         "api",
+				Name:        "beta-checkout",
+				Enable:      true,
+				Priority:    100,
+				Type:        RuleTypeComposite,
+				MarkerValue: "checkout-v3",
+				Conditions: &Condition{
+					All: []Condition{
+						{Rule: Rule{Type: RuleTypeIdentify, UserIds: []string{"user001"}}},
+						{Rule: Rule{Type: RuleTypeVersion, MinVersion: "3.0.0", MaxVersion: "99.0.0"}},
+						{Any: []Condition{
+							{Rule: Rule{Type: RuleTypePath, Path: "/checkout"}},
+							{Rule: Rule{Type: RuleTypePath, Path: "/cart"}},
+						}},
+						{Not: &Condition{Rule: Rule{Type: RuleTypePath, Path: "/checkout/legacy"}}},
+					},
+				},
+			},
+		},
+	}
+
+	marker := &Marker{
+		next:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		config: config,
+		logger: NewLogger("DEBUG"),
+	}
+
+	tests := []struct {
+		target   string
+		user     string
+		version  string
+		expected string
+	}{
+		{"/checkout/pay", "user001", "3.1.0", "checkout-v3"},
+		{"/cart", "user001", "3.0.0", "checkout-v3"},
+		{"/checkout/legacy", "user001", "3.1.0", ""},
+		{"/checkout/pay", "user002", "3.1.0", ""},
+		{"/checkout/pay", "user001", "2.9.0", ""},
+		{"/orders", "user001", "3.1.0", ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.target, nil)
+		req.Header.Set("X-User-ID", tt.user)
+		req.Header.Set("X-Version", tt.version)
+		marker.ServeHTTP(httptest.NewRecorder(), req)
+
+		if req.Header.Get("X-MARK") != tt.expected {
+			t.Errorf("%s user=%s version=%s: expected X-MARK=%q, got %q",
+				tt.target, tt.user, tt.version, tt.expected, req.Header.Get("X-MARK"))
+		}
+	}
+}
+
+func TestMatchByAttribute(t *testing.T) {
+	marker := &Marker{logger: NewLogger("DEBUG")}
+
+	req := httptest.NewRequest("GET", "/test?debug=1&tag=a,b", nil)
+	req.Header.Set("X-Region", "eu-west")
+	req.Header.Set("X-Platform", "ios")
+	req.AddCookie(&http.Cookie{Name: "plan", Value: "pro"})
+
+	tests := []struct {
+		name     string
+		rule     Rule
+		expected bool
+	}{
+		{"header equals", Rule{Type: RuleTypeHeader, Key: "x-platform", Values: []string{"ios"}}, true},
+		{"header equals mismatch", Rule{Type: RuleTypeHeader, Key: "X-Platform", Operator: MatchOperatorEquals, Values: []string{"android"}}, false},
+		{"header in", Rule{Type: RuleTypeHeader, Key: "X-Platform", Operator: MatchOperatorIn, Values: []string{"android", "ios"}}, true},
+		{"header regex", Rule{Type: RuleTypeHeader, Key: "X-Region", Operator: MatchOperatorRegex, Values: []string{"^eu-"}}, true},
+		{"header exists", Rule{Type: RuleTypeHeader, Key: "X-Region", Operator: MatchOperatorExists}, true},
+		{"header absent", Rule{Type: RuleTypeHeader, Key: "X-Canary", Operator: MatchOperatorAbsent}, true},
+		{"header missing equals", Rule{Type: RuleTypeHeader, Key: "X-Canary", Values: []string{""}}, false},
+		{"cookie equals", Rule{Type: RuleTypeCookie, Key: "plan", Values: []string{"pro"}}, true},
+		{"cookie absent", Rule{Type: RuleTypeCookie, Key: "plan", Operator: MatchOperatorAbsent}, false},
+		{"query equals", Rule{Type: RuleTypeQuery, Key: "debug", Values: []string{"1"}}, true},
+		{"query exists", Rule{Type: RuleTypeQuery, Key: "trace", Operator: MatchOperatorExists}, false},
+	}
+
+	for _, tt := range tests {
+		matched, err := marker.matchByAttribute(tt.rule, req)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if matched != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, matched)
+		}
+	}
+}
+
+func TestMarkerServeHTTP_MethodAndHostConstraints(t *testing.T) {
+	config := &Config{
+		Tag:       "api",
+		LogLevel:  "DEBUG",
+		MarkerKey: "X-MARK",
+		StaticRules: []Rule{
+			{
+				Tag:         "api",
+				Name:        "eu-orders-write",
+				Enable:      true,
+				Priority:    100,
+				Type:        RuleTypePath,
+				MarkerValue: "write-v2",
+				Path:        "/orders",
+				Methods:     []string{"POST", "put"},
+				Hosts:       []string{"api.eu.example.com", "*.staging.example.com"},
+			},
+		},
+	}
+
+	marker := &Marker{
+		next:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		config: config,
+		logger: NewLogger("DEBUG"),
+	}
+
+	tests := []struct {
+		method   string
+		host     string
+		expected string
+	}{
+		{"POST", "api.eu.example.com", "write-v2"},
+		{"PUT", "API.EU.example.com:8443", "write-v2"},
+		{"GET", "api.eu.example.com", ""},
+		{"POST", "api.us.example.com", ""},
+		{"POST", "eu.staging.example.com", "write-v2"},
+		{"POST", "staging.example.com", ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/orders", nil)
+		req.Host = tt.host
+		marker.ServeHTTP(httptest.NewRecorder(), req)
+
+		if req.Header.Get("X-MARK") != tt.expected {
+			t.Errorf("%s %s: expected X-MARK=%q, got %q", tt.method, tt.host, tt.expected, req.Header.Get("X-MARK"))
+		}
+	}
+}
+
+func TestSelectVariant_DistributionAndDeterminism(t *testing.T) {
+	config := &Config{IdentifyHeader: "X-User-ID"}
+	marker := &Marker{config: config, logger: NewLogger("ERROR")}
+
+	rule := Rule{
+		Name: "checkout-test",
+		Type: RuleTypeSplit,
+		Salt: "checkout-2024",
+		Variants: []Variant{
+			{Value: "control", Weight: 50},
+			{Value: "a", Weight: 25},
+			{Value: "b", Weight: 25},
+		},
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User-ID", fmt.Sprintf("user-%d", i))
+		variant, err := marker.selectVariant(rule, req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		again, _ := marker.selectVariant(rule, req)
+		if variant != again {
+			t.Fatalf("expected deterministic assignment, got %s then %s", variant, again)
+		}
+		counts[variant]++
+	}
+
+	expected := map[string]int{"control": 5000, "a": 2500, "b": 2500}
+	for variant, want := range expected {
+		if got := counts[variant]; got < want*9/10 || got > want*11/10 {
+			t.Errorf("variant %s got %d assignments, expected about %d", variant, got, want)
+		}
+	}
+}
+
+func TestSelectVariant_SaltDecorrelates(t *testing.T) {
+	config := &Config{IdentifyHeader: "X-User-ID"}
+	marker := &Marker{config: config, logger: NewLogger("ERROR")}
+
+	variants := []Variant{{Value: "off", Weight: 50}, {Value: "on", Weight: 50}}
+	tests := []struct {
+		name  string
+		ruleA Rule
+		ruleB Rule
+	}{
+		{"salts", Rule{Name: "a", Salt: "experiment-a"}, Rule{Name: "b", Salt: "experiment-b"}},
+		{"names without salt", Rule{Name: "experiment-a"}, Rule{Name: "experiment-b"}},
+	}
+
+	for _, tt := range tests {
+		tt.ruleA.Type, tt.ruleA.Variants = RuleTypeSplit, variants
+		tt.ruleB.Type, tt.ruleB.Variants = RuleTypeSplit, variants
+
+		same := 0
+		for i := 0; i < 2000; i++ {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-User-ID", fmt.Sprintf("user-%d", i))
+			a, _ := marker.selectVariant(tt.ruleA, req)
+			b, _ := marker.selectVariant(tt.ruleB, req)
+			if a == b {
+				same++
+			}
+		}
+
+		// Independent experiments agree about half of the time
+		if same < 800 || same > 1200 {
+			t.Errorf("%s: expected experiments to be independent, %d/2000 assignments agree", tt.name, same)
+		}
+	}
+}
+
+func TestMarkerServeHTTP_SplitRule(t *testing.T) {
+	config := &Config{
+		Tag:            "api",
+		LogLevel:       "DEBUG",
+		MarkerKey:      "X-MARK",
+		IdentifyHeader: "X-User-ID",
+		StaticRules: []Rule{
+			{
+				Tag:      "api",
+				Name:     "abc-test",
+				Enable:   true,
+				Priority: 100,
+				Type:     RuleTypeSplit,
+				Salt:     "abc",
+				Variants: []Variant{{Value: "only", Weight: 1}, {Value: "never", Weight: 0}},
+			},
+		},
+	}
+
+	marker := &Marker{
+		next:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		config: config,
+		logger: NewLogger("DEBUG"),
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-User-ID", "user001")
+	marker.ServeHTTP(httptest.NewRecorder(), req)
+	if req.Header.Get("X-MARK") != "only" {
+		t.Errorf("expected X-MARK=only, got %s", req.Header.Get("X-MARK"))
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	marker.ServeHTTP(httptest.NewRecorder(), req)
+	if req.Header.Get("X-MARK") != "" {
+		t.Errorf("expected no mark without identity, got %s", req.Header.Get("X-MARK"))
+	}
+}
+
+func TestMatchByWeight_Bucketing(t *testing.T) {
+	config := &Config{IdentifyHeader: "X-User-ID"}
+	marker := &Marker{config: config, logger: NewLogger("ERROR")}
+
+	countMatches := func(rule Rule) map[string]bool {
+		matched := map[string]bool{}
+		for i := 0; i < 10000; i++ {
+			user := fmt.Sprintf("user-%d", i)
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-User-ID", user)
+			if ok, _ := marker.matchByWeight(rule, req); ok {
+				matched[user] = true
+			}
+		}
+		return matched
+	}
+
+	if n := len(countMatches(Rule{Type: RuleTypeCanary, Canary: 0})); n != 0 {
+		t.Errorf("expected canary=0 to admit nobody, got %d", n)
+	}
+	if n := len(countMatches(Rule{Type: RuleTypeCanary, Canary: 100})); n != 10000 {
+		t.Errorf("expected canary=100 to admit everybody, got %d", n)
+	}
+	if n := len(countMatches(Rule{Type: RuleTypeCanary, CanaryBps: 50})); n < 30 || n > 70 {
+		t.Errorf("expected canaryBps=50 to admit about 0.5%%, got %d/10000", n)
+	}
+
+	// Growing a canary keeps its original cohort
+	small := countMatches(Rule{Type: RuleTypeCanary, Salt: "checkout", Canary: 5})
+	large := countMatches(Rule{Type: RuleTypeCanary, Salt: "checkout", Canary: 20})
+	for user := range small {
+		if !large[user] {
+			t.Fatalf("user %s left the canary when it grew from 5%% to 20%%", user)
+		}
+	}
+
+	ranged := countMatches(Rule{Type: RuleTypeCanary, Salt: "checkout", Buckets: []BucketRange{{From: 0, To: 500}, {From: 5000, To: 6500}}})
+	for user := range small {
+		if !ranged[user] {
+			t.Fatalf("user %s in [0,500) is missing from explicit bucket ranges", user)
+		}
+	}
+	if n := len(ranged); n < 1800 || n > 2200 {
+		t.Errorf("expected bucket ranges to admit about 20%%, got %d/10000", n)
+	}
+
+	// Unsalted canaries keep the cohort of the former hash%100 <= canary check,
+	// apart from its off-by-one extra percent
+	legacy := countMatches(Rule{Type: RuleTypeCanary, Canary: 30})
+	for i := 0; i < 10000; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(user))
+		percent := int(h.Sum32()) % 100
+		if percent < 30 && !legacy[user] {
+			t.Fatalf("user %s in percent bucket %d left the unsalted canary", user, percent)
+		}
+		if percent >= 30 && legacy[user] {
+			t.Fatalf("user %s in percent bucket %d joined the unsalted canary", user, percent)
+		}
+	}
+
+	// Different salts select different cohorts
+	other := countMatches(Rule{Type: RuleTypeCanary, Salt: "search", Canary: 5})
+	overlap := 0
+	for user := range small {
+		if other[user] {
+			overlap++
+		}
+	}
+	if overlap > len(small)/2 {
+		t.Errorf("expected salted canaries to be independent, %d/%d users overlap", overlap, len(small))
+	}
+}
+
+// fakeRedisConn serves the handful of commands the marker issues from
+// in-memory lists, hashes and sets.
+type fakeRedisConn struct {
+	lists   map[string][]string
+	hashes  map[string]map[string]string
+	sets    map[string][]string
+	strings map[string]string
+	loaded  bool
+	scanned int
+	calls   int
+	delay   time.Duration
+}
+
+func (c *fakeRedisConn) Close() error                               { return nil }
+func (c *fakeRedisConn) Err() error                                 { return nil }
+func (c *fakeRedisConn) Send(cmd string, args ...interface{}) error { return nil }
+func (c *fakeRedisConn) Flush() error                               { return nil }
+func (c *fakeRedisConn) Receive() (interface{}, error)              { return nil, nil }
+
+func (c *fakeRedisConn) ReceiveContext(ctx context.Context) (interface{}, error) { return nil, nil }
+
+func (c *fakeRedisConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	select {
+	case <-time.After(c.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return c.Do(cmd, args...)
+}
+
+func (c *fakeRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	// The pool issues an empty command to flush a connection on release
+	if cmd == "" {
+		return nil, nil
+	}
+	c.calls++
+	key := fmt.Sprint(args[0])
+	switch cmd {
+	case "SISMEMBER":
+		for _, member := range c.sets[key] {
+			if member == fmt.Sprint(args[1]) {
+				return int64(1), nil
+			}
+		}
+		return int64(0), nil
+	case "EVALSHA", "EVAL":
+		// Emulate rulesSnapshotScript, which must be loaded by EVAL first
+		if cmd == "EVALSHA" && !c.loaded {
+			return nil, redis.Error("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		c.loaded = true
+		listKey, version := fmt.Sprint(args[2]), ""
+		if pointer := fmt.Sprint(args[3]); pointer != "" {
+			var ok bool
+			if version, ok = c.strings[pointer]; !ok {
+				return nil, redis.Error("ERR active version key " + pointer + " is not set")
+			}
+			listKey = versionedRulesKey(listKey, version)
+		}
+		entries := []interface{}{}
+		for _, ruleKey := range c.lists[listKey] {
+			if v, ok := c.strings[ruleKey]; ok {
+				entries = append(entries, []interface{}{[]byte(ruleKey), []byte(v)})
+				continue
+			}
+			fields := make([]interface{}, 0, len(c.hashes[ruleKey])*2)
+			for field, v := range c.hashes[ruleKey] {
+				fields = append(fields, []byte(field), []byte(v))
+			}
+			entries = append(entries, []interface{}{[]byte(ruleKey), fields})
+		}
+		return []interface{}{[]byte(version), entries}, nil
+	case "SSCAN":
+		// Return two members per page to exercise the cursor loop
+		var cursor int
+		fmt.Sscan(fmt.Sprint(args[1]), &cursor)
+		c.scanned++
+		members := c.sets[key]
+		end := cursor + 2
+		next := end
+		if end >= len(members) {
+			end, next = len(members), 0
+		}
+		page := make([]interface{}, 0, 2)
+		for _, v := range members[cursor:end] {
+			page = append(page, []byte(v))
+		}
+		return []interface{}{[]byte(fmt.Sprint(next)), page}, nil
+	}
+	return nil, fmt.Errorf("unsupported command %s", cmd)
+}
+
+func TestRefreshConfig_JSONRules(t *testing.T) {
+	conn := &fakeRedisConn{
+		lists: map[string][]string{"rules": {"rule:hash", "rule:string", "rule:field"}},
+		hashes: map[string]map[string]string{
+			"rule:hash": {FieldName: "hash", FieldEnable: "1", FieldPriority: "1", FieldType: "path", FieldPath: "/hash", FieldMarkValue: "hash"},
+			"rule:field": {
+				FieldJSON: `{"schemaVersion":1,"name":"field","enable":true,"type":"path","path":"/field","markerValue":"field"}`,
+			},
+		},
+		strings: map[string]string{
+			"rule:string": `{"schemaVersion":1,"name":"string","enable":true,"type":"header","key":"X-Team","operator":"in","values":["a,b","c"],"markerValue":"string"}`,
+		},
+	}
+	marker := &Marker{
+		next:      http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		redisPool: &redis.Pool{Dial: func() (redis.Conn, error) { return conn, nil }},
+		logger:    NewLogger("DEBUG"),
+		config:    &Config{MarkerKey: "X-MARK", RedisConfig: RedisConfig{RuleListKeys: "rules"}},
+	}
+
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(marker.config.StaticRules) != 3 {
+		t.Fatalf("expected 3 rules, got %d", len(marker.config.StaticRules))
+	}
+
+	tests := []struct {
+		path     string
+		team     string
+		expected string
+	}{
+		{"/hash", "", "hash"},
+		{"/field", "", "field"},
+		{"/", "a,b", "string"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("X-Team", tt.team)
+		marker.ServeHTTP(httptest.NewRecorder(), req)
+		if got := req.Header.Get("X-MARK"); got != tt.expected {
+			t.Errorf("%s: expected mark %q, got %q", tt.path, tt.expected, got)
+		}
+	}
+}
+
+func TestRefreshConfig_SnapshotScript(t *testing.T) {
+	conn := snapshotConn("a", "b", "c")
+	marker := newSnapshotMarker(conn, SnapshotPolicy{})
+
+	// The first refresh loads the script, later ones only send its hash
+	for i, expected := range []int{2, 1} {
+		conn.calls = 0
+		if err := marker.refreshConfig(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if conn.calls != expected {
+			t.Errorf("refresh %d: expected %d round trips, got %d", i, expected, conn.calls)
+		}
+	}
+	if len(marker.config.StaticRules) != 3 {
+		t.Errorf("expected 3 rules, got %d", len(marker.config.StaticRules))
+	}
+}
+
+func TestDecodeRuleEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   interface{}
+		wantErr bool
+	}{
+		{"hash", []interface{}{[]byte("rule:a"), []interface{}{[]byte(FieldName), []byte("a"), []byte(FieldType), []byte("path"), []byte(FieldPath), []byte("/"), []byte(FieldMarkValue), []byte("a")}}, false},
+		{"json", []interface{}{[]byte("rule:a"), []byte(`{"schemaVersion":1,"name":"a","type":"path","path":"/","markerValue":"a"}`)}, false},
+		{"missing key", []interface{}{[]byte("rule:a"), []interface{}{}}, true},
+		{"not a pair", []interface{}{[]byte("rule:a")}, true},
+		{"unexpected reply", []interface{}{[]byte("rule:a"), int64(1)}, true},
+	}
+
+	for _, tt := range tests {
+		_, _, err := decodeRuleEntry(tt.entry)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
+
+func TestScanSet(t *testing.T) {
+	conn := &fakeRedisConn{sets: map[string][]string{
+		"beta":     {"u1", "u2", "u3", "u4", "u5"},
+		"shuffled": {"u5", "u3", "u1", "u3", "u4", "u2"},
+	}}
+
+	members := map[string]struct{}{}
+	digest, err := scanSet(conn, "beta", members)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(members) != 5 || conn.scanned != 3 {
+		t.Errorf("expected 5 members in 3 pages, got %v in %d pages", members, conn.scanned)
+	}
+
+	// The digest ignores scan order and repeated members
+	shuffled, err := scanSet(conn, "shuffled", map[string]struct{}{})
+	if err != nil || shuffled != digest {
+		t.Errorf("expected digest %x for the same members, got %x, %v", digest, shuffled, err)
+	}
+
+	members = map[string]struct{}{}
+	if digest, err = scanSet(conn, "missing", members); err != nil || len(members) != 0 || digest != 0 {
+		t.Errorf("expected empty set, got %v, %v", members, err)
+	}
+}
+
+func TestRefreshConfig_IdentifyUserIdsKey(t *testing.T) {
+	conn := &fakeRedisConn{
+		lists: map[string][]string{"rules": {"rule:beta"}},
+		hashes: map[string]map[string]string{
+			"rule:beta": {
+				FieldName:       "beta",
+				FieldEnable:     "1",
+				FieldType:       "identify",
+				FieldMarkValue:  "beta",
+				FieldUserIds:    "inline",
+				FieldUserIdsKey: "beta:users",
+			},
+		},
+		sets: map[string][]string{"beta:users": {"u1", "u2", "u3"}},
+	}
+	marker := &Marker{
+		next:      http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		redisPool: &redis.Pool{Dial: func() (redis.Conn, error) { return conn, nil }},
+		logger:    NewLogger("DEBUG"),
+		config:    &Config{MarkerKey: "X-MARK", IdentifyHeader: "X-User-ID", RedisConfig: RedisConfig{RuleListKeys: "rules"}},
+	}
+
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if conn.scanned != 2 {
+		t.Errorf("expected user ids to be scanned in 2 pages, got %d", conn.scanned)
+	}
+
+	for _, userID := range []string{"inline", "u1", "u3"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User-ID", userID)
+		marker.ServeHTTP(httptest.NewRecorder(), req)
+		if req.Header.Get("X-MARK") != "beta" {
+			t.Errorf("expected %s to be marked beta, got %q", userID, req.Header.Get("X-MARK"))
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-User-ID", "u4")
+	marker.ServeHTTP(httptest.NewRecorder(), req)
+	if req.Header.Get("X-MARK") != "" {
+		t.Errorf("expected u4 to stay unmarked, got %q", req.Header.Get("X-MARK"))
+	}
+
+	// Members are kept in the compiled set only, and versioned by their digest
+	if rules := marker.config.StaticRules; len(rules) != 1 || len(rules[0].UserIds) != 1 {
+		t.Fatalf("expected userIds to stay as configured, got %v", rules)
+	}
+	version := marker.snapshot.version
+	if err := marker.refreshConfig(); err != nil || marker.snapshot.version != version {
+		t.Errorf("expected an unchanged cohort to keep version %s, got %s (%v)", version, marker.snapshot.version, err)
+	}
+	conn.sets["beta:users"] = []string{"u1", "u2", "u4"}
+	if err := marker.refreshConfig(); err != nil || marker.snapshot.version == version {
+		t.Errorf("expected a changed cohort to change version %s (%v)", version, err)
+	}
+}
+
+func TestRefreshConfig_CompositeUserIdsKey(t *testing.T) {
+	conn := &fakeRedisConn{
+		lists: map[string][]string{"rules": {"rule:checkout"}},
+		strings: map[string]string{
+			"rule:checkout": `{"schemaVersion":1,"name":"checkout","enable":true,"type":"composite","markerValue":"checkout",` +
+				`"conditions":{"all":[{"type":"path","path":"/checkout"},{"type":"identify","userIdsKey":"beta:users"}]}}`,
+		},
+		sets: map[string][]string{"beta:users": {"u1", "u2", "u3"}},
+	}
+	marker := &Marker{
+		next:      http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		redisPool: &redis.Pool{Dial: func() (redis.Conn, error) { return conn, nil }},
+		logger:    NewLogger("DEBUG"),
+		config:    &Config{MarkerKey: "X-MARK", IdentifyHeader: "X-User-ID", RedisConfig: RedisConfig{RuleListKeys: "rules"}},
+	}
+
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		userID   string
+		expected string
+	}{
+		{"u2", "checkout"},
+		{"u4", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/checkout", nil)
+		req.Header.Set("X-User-ID", tt.userID)
+		marker.ServeHTTP(httptest.NewRecorder(), req)
+		if req.Header.Get("X-MARK") != tt.expected {
+			t.Errorf("%s: expected mark %q, got %q", tt.userID, tt.expected, req.Header.Get("X-MARK"))
+		}
+	}
+}
+
+func TestNew_StaticUserIdsKey(t *testing.T) {
+	identify := Rule{Type: RuleTypeIdentify, UserIdsKey: "beta:users"}
+	live := Rule{Type: RuleTypeIdentify, UserIdsKey: "beta:users", UserIdsLookup: UserIdsLookupLive}
+	tests := []struct {
+		name    string
+		rule    Rule
+		redis   bool
+		wantErr bool
+	}{
+		{"loaded", identify, true, true},
+		{"loaded in leaf", Rule{Type: RuleTypeComposite, Conditions: &Condition{Any: []Condition{{Rule: identify}}}}, true, true},
+		{"live", live, true, false},
+		{"live without redis", live, false, true},
+		{"live in leaf without redis", Rule{Type: RuleTypeComposite, Conditions: &Condition{Not: &Condition{Rule: live}}}, false, true},
+	}
+
+	for _, tt := range tests {
+		tt.rule.Name, tt.rule.MarkerValue = "beta", "beta"
+		config := &Config{
+			MarkerKey:   "X-MARK",
+			StaticRules: []Rule{tt.rule},
+			RedisConfig: RedisConfig{Enable: tt.redis, Addr: "localhost:6379", RuleListKeys: "rules"},
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		_, err := New(ctx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "test")
+		cancel()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		interval time.Duration
+		expected time.Duration
+	}{
+		{1, time.Hour, time.Second},
+		{2, time.Hour, 2 * time.Second},
+		{4, time.Hour, 8 * time.Second},
+		{7, time.Hour, time.Minute},
+		{100, time.Hour, time.Minute},
+		{4, 5 * time.Second, 5 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := retryBackoff(tt.failures, tt.interval); got != tt.expected {
+			t.Errorf("retryBackoff(%d, %s): expected %s, got %s", tt.failures, tt.interval, tt.expected, got)
+		}
+	}
+}
+
+func TestRefreshLoop_RecoversAfterStartupFailure(t *testing.T) {
+	conn := &fakeRedisConn{
+		lists: map[string][]string{"rules": {"rule:beta"}},
+		hashes: map[string]map[string]string{
+			"rule:beta": {
+				FieldName:      "beta",
+				FieldEnable:    "1",
+				FieldType:      "identify",
+				FieldMarkValue: "beta",
+				FieldUserIds:   "user001",
+			},
+		},
+	}
+
+	var mu sync.Mutex
+	dials := 0
+	marker := &Marker{
+		logger: NewLogger("DEBUG"),
+		config: &Config{RedisConfig: RedisConfig{RuleListKeys: "rules"}},
+		redisPool: &redis.Pool{Dial: func() (redis.Conn, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			// Redis is unreachable for the first two attempts
+			dials++
+			if dials <= 2 {
+				return nil, errors.New("connection refused")
+			}
+			return conn, nil
+		}},
+	}
+
+	if err := marker.refreshConfig(); err == nil {
+		t.Fatalf("expected startup load to fail")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go marker.refreshLoop(ctx, 10*time.Millisecond, 1, nil)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		marker.mu.RLock()
+		loaded := len(marker.config.StaticRules)
+		marker.mu.RUnlock()
+		if loaded == 1 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Errorf("expected rules to be loaded after Redis became reachable")
+}
+
+func TestRefreshConfig_FiltersByTag(t *testing.T) {
+	conn := &fakeRedisConn{
+		lists: map[string][]string{"rules": {"rule:api", "rule:shared", "rule:web", "rule:untagged"}},
+		hashes: map[string]map[string]string{
+			"rule:api":      {FieldTag: "api", FieldName: "api", FieldEnable: "1", FieldType: "path", FieldMarkValue: "api", FieldPath: "/"},
+			"rule:shared":   {FieldTag: "api,web", FieldName: "shared", FieldEnable: "1", FieldType: "path", FieldMarkValue: "shared", FieldPath: "/"},
+			"rule:web":      {FieldTag: "web", FieldName: "web", FieldEnable: "1", FieldType: "path", FieldMarkValue: "web", FieldPath: "/"},
+			"rule:untagged": {FieldName: "untagged", FieldEnable: "1", FieldType: "path", FieldMarkValue: "untagged", FieldPath: "/"},
+		},
+	}
+
+	tests := []struct {
+		tag      string
+		expected []string
+	}{
+		{"api", []string{"api", "shared"}},
+		{"web", []string{"shared", "web"}},
+		{"", []string{"untagged"}},
+	}
+
+	for _, tt := range tests {
+		marker := &Marker{
+			logger:    NewLogger("DEBUG"),
+			config:    &Config{Tag: tt.tag, RedisConfig: RedisConfig{RuleListKeys: "rules"}},
+			redisPool: &redis.Pool{Dial: func() (redis.Conn, error) { return conn, nil }},
+		}
+		if err := marker.refreshConfig(); err != nil {
+			t.Fatalf("tag %q: unexpected error: %v", tt.tag, err)
+		}
+
+		names := make([]string, 0, len(marker.config.StaticRules))
+		for _, rule := range marker.config.StaticRules {
+			names = append(names, rule.Name)
+		}
+		sort.Strings(names)
+		if fmt.Sprint(names) != fmt.Sprint(tt.expected) {
+			t.Errorf("tag %q: expected rules %v, got %v", tt.tag, tt.expected, names)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package request_marker
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const defaultPlatformHeader = "User-Agent"
+
+type platformPattern struct {
+	platform string
+	header   string
+	pattern  *regexp.Regexp
+}
+
+// compileVersionPattern compiles Config.VersionPattern. The version is taken
+// from the "version" named group, else the first group, else the whole match.
+func compileVersionPattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid versionPattern %q: %w", pattern, err)
+	}
+	return re, nil
+}
+
+func compilePlatformPatterns(patterns []PlatformPattern) ([]platformPattern, error) {
+	compiled := make([]platformPattern, 0, len(patterns))
+	for _, p := range patterns {
+		if p.Platform == "" {
+			return nil, fmt.Errorf("platform pattern requires platform")
+		}
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for platform %s: %w", p.Platform, err)
+		}
+		header := p.Header
+		if header == "" {
+			header = defaultPlatformHeader
+		}
+		compiled = append(compiled, platformPattern{platform: strings.ToLower(p.Platform), header: header, pattern: re})
+	}
+	return compiled, nil
+}
+
+// extractVersion reads the client version from VersionHeader, optionally
+// pulling it out of a longer value such as "MyApp/3.4.1 (iOS 17)".
+func (mk *Marker) extractVersion(req *http.Request) string {
+	value := req.Header.Get(mk.config.VersionHeader)
+	if value == "" || mk.versionPattern == nil {
+		return value
+	}
+
+	match := mk.versionPattern.FindStringSubmatch(value)
+	if match == nil {
+		return ""
+	}
+	if i := mk.versionPattern.SubexpIndex("version"); i > 0 {
+		return match[i]
+	}
+	if len(match) > 1 {
+		return match[1]
+	}
+	return match[0]
+}
+
+// detectPlatform returns the lower-cased client platform, read from
+// PlatformHeader first and then from the first matching platform pattern.
+func (mk *Marker) detectPlatform(req *http.Request) string {
+	if mk.config.PlatformHeader != "" {
+		if platform := strings.TrimSpace(req.Header.Get(mk.config.PlatformHeader)); platform != "" {
+			return strings.ToLower(platform)
+		}
+	}
+	for _, p := range mk.platformPatterns {
+		if p.pattern.MatchString(req.Header.Get(p.header)) {
+			return p.platform
+		}
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+package request_marker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExtractVersion_Pattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		value    string
+		expected string
+	}{
+		{"", "3.4.1", "3.4.1"},
+		{`MyApp/([0-9.]+)`, "MyApp/3.4.1 (iOS 17)", "3.4.1"},
+		{`(iOS|Android) MyApp/(?P<version>\S+)`, "Android MyApp/3.2.0-beta.1", "3.2.0-beta.1"},
+		{`MyApp/[0-9.]+`, "MyApp/3.4.1", "MyApp/3.4.1"},
+		{`MyApp/([0-9.]+)`, "Mozilla/5.0", ""},
+	}
+
+	for _, tt := range tests {
+		config := &Config{VersionHeader: "User-Agent", VersionPattern: tt.pattern}
+		marker := &Marker{config: config, logger: NewLogger("DEBUG")}
+		if tt.pattern != "" {
+			re, err := compileVersionPattern(tt.pattern)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			marker.versionPattern = re
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("User-Agent", tt.value)
+		if got := marker.extractVersion(req); got != tt.expected {
+			t.Errorf("extractVersion(%q, %q) = %q, expected %q", tt.pattern, tt.value, got, tt.expected)
+		}
+	}
+}
+
+func TestMarkerServeHTTP_PlatformVersions(t *testing.T) {
+	config := &Config{
+		Tag:            "api",
+		LogLevel:       "DEBUG",
+		MarkerKey:      "X-MARK",
+		VersionHeader:  "User-Agent",
+		VersionPattern: `MyApp/(?P<version>[0-9A-Za-z.\-]+)`,
+		PlatformHeader: "X-Platform",
+		PlatformPatterns: []PlatformPattern{
+			{Platform: "ios", Pattern: `\((iOS|iPadOS) `},
+			{Platform: "android", Pattern: `\(Android `},
+		},
+		StaticRules: []Rule{
+			{
+				Tag:         "api",
+				Name:        "new-app",
+				Enable:      true,
+				Priority:    100,
+				Type:        RuleTypeVersion,
+				MarkerValue: "new-app",
+				MinVersion:  "4.0.0",
+				PlatformVersions: []PlatformVersion{
+					{Platform: "iOS", MinVersion: "3.4.0"},
+					{Platform: "android", MinVersion: "3.2.0"},
+				},
+			},
+		},
+	}
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		userAgent string
+		platform  string
+		expected  string
+	}{
+		{"MyApp/3.4.1 (iOS 17)", "", "new-app"},
+		{"MyApp/3.3.0 (iOS 17)", "", ""},
+		{"MyApp/3.2.0 (Android 14)", "", "new-app"},
+		{"MyApp/3.1.9 (Android 14)", "", ""},
+		{"MyApp/3.3.0 (Android 14)", "ios", ""},
+		{"MyApp/3.9.0 (Windows NT)", "", ""},
+		{"MyApp/4.0.0 (Windows NT)", "", "new-app"},
+		{"Mozilla/5.0 (iOS 17)", "", ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("User-Agent", tt.userAgent)
+		if tt.platform != "" {
+			req.Header.Set("X-Platform", tt.platform)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if req.Header.Get("X-MARK") != tt.expected {
+			t.Errorf("UA=%q platform=%q: expected X-MARK=%q, got %q", tt.userAgent, tt.platform, tt.expected, req.Header.Get("X-MARK"))
+		}
+	}
+}
+
+func TestNew_InvalidPlatformPattern(t *testing.T) {
+	config := &Config{
+		PlatformPatterns: []PlatformPattern{{Platform: "ios", Pattern: "("}},
+	}
+
+	_, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "test")
+	if err == nil {
+		t.Errorf("expected error for invalid platform pattern")
+	}
+}
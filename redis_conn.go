@@ -1,8 +1,10 @@
 package request_marker
 
 import (
+	"context"
 	"fmt"
 	"github.com/qxsugar/request-marker/redis"
+	"time"
 )
 
 func NewRedis(addr, password string, db int) (redis.Conn, error) {
@@ -29,3 +31,91 @@ func NewRedis(addr, password string, db int) (redis.Conn, error) {
 
 	return conn, nil
 }
+
+const (
+	redisIOTimeout     = 5 * time.Second
+	redisPingAfterIdle = time.Minute
+)
+
+// newRedisPool returns the pool used by rule refreshes. Dialing honours the
+// caller's context, and connections idle for a while are pinged on borrow so
+// that a restarted Redis is noticed before a command fails.
+func newRedisPool(config RedisConfig) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     16,
+		IdleTimeout: 4 * time.Minute,
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			return redis.DialContext(ctx, "tcp", config.Addr,
+				redis.DialPassword(config.Password),
+				redis.DialDatabase(config.DB),
+				redis.DialConnectTimeout(redisIOTimeout),
+				redis.DialReadTimeout(redisIOTimeout),
+				redis.DialWriteTimeout(redisIOTimeout),
+			)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < redisPingAfterIdle {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+// newLookupPool returns the pool of request-time lookups. It never pings on
+// borrow: the pool runs that PING under redisIOTimeout regardless of the
+// caller's context, which would let a half-dead Redis hold a request far past
+// lookupTimeout. A stale connection fails its lookup instead and is discarded.
+func newLookupPool(config RedisConfig) *redis.Pool {
+	pool := newRedisPool(config)
+	pool.TestOnBorrow = nil
+	return pool
+}
+
+// dialRedis opens a connection outside of the pool using the pool's dialer,
+// for long-lived uses such as Pub/Sub subscriptions.
+func dialRedis(ctx context.Context, pool *redis.Pool) (redis.Conn, error) {
+	if pool.DialContext != nil {
+		return pool.DialContext(ctx)
+	}
+	return pool.Dial()
+}
+
+// rulesSnapshotScript reads the rule list and every rule it references in one
+// atomic call, so a refresh costs a single round trip and never observes a list
+// that an operator is half way through editing. When KEYS[2] names an active
+// version pointer, the list of that version is read instead, resolving the
+// pointer in the same call. It replies with the version and a {key, rule} pair
+// per listed key, where rule is the HGETALL reply of a hash rule or the JSON
+// document of a string rule. The rule keys are not declared as KEYS, so the
+// script requires a non-clustered Redis.
+var rulesSnapshotScript = redis.NewScript(2, `
+local listKey = KEYS[1]
+local version = ''
+if KEYS[2] ~= '' then
+	version = redis.call('GET', KEYS[2])
+	if not version then
+		return redis.error_reply('active version key ' .. KEYS[2] .. ' is not set')
+	end
+	listKey = listKey .. ':v' .. version
+end
+local entries = {}
+for i, key in ipairs(redis.call('LRANGE', listKey, 0, -1)) do
+	if redis.call('TYPE', key).ok == 'string' then
+		entries[i] = {key, redis.call('GET', key)}
+	else
+		entries[i] = {key, redis.call('HGETALL', key)}
+	end
+end
+return {version, entries}
+`)
+
+// versionedRulesKey returns the rule list key of one version of a rule set,
+// e.g. marker:api:rules:v42. It must agree with rulesSnapshotScript.
+func versionedRulesKey(listKey, version string) string {
+	if version == "" {
+		return listKey
+	}
+	return listKey + ":v" + version
+}
@@ -0,0 +1,124 @@
+package request_marker
+
+import (
+	"fmt"
+	"github.com/qxsugar/request-marker/redis"
+)
+
+// redisSource loads the rules listed under RuleListKeys, or under the version
+// named by ActiveVersionKey.
+type redisSource struct {
+	pool   *redis.Pool
+	config RedisConfig
+	tag    string
+	logger *Logger
+}
+
+// load reads the whole rule set in one atomic call. Rules that cannot be
+// fetched or parsed are logged and counted in failed, so that the snapshot
+// policy can decide whether the rest is still usable.
+func (s *redisSource) load() (*ruleSet, error) {
+	redisConfig := s.config
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	reply, err := redis.Values(rulesSnapshotScript.Do(conn, redisConfig.RuleListKeys, redisConfig.ActiveVersionKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch rules from Redis: %w", err)
+	}
+	if len(reply) != 2 {
+		return nil, fmt.Errorf("unexpected snapshot reply length %d", len(reply))
+	}
+	version, err := redis.String(reply[0], nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid active version: %w", err)
+	}
+	entries, err := redis.Values(reply[1], nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot reply: %w", err)
+	}
+
+	rulesListKey := versionedRulesKey(redisConfig.RuleListKeys, version)
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no rules found in Redis key: %s", rulesListKey)
+	}
+
+	source := ruleSourceRedis
+	if version != "" {
+		source += ":v" + version
+	}
+
+	rules := make([]Rule, 0, len(entries))
+	failed := 0
+
+	for _, entry := range entries {
+		ruleKey, rule, err := decodeRuleEntry(entry)
+		if err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to load rule (key=%s): %v", ruleKey, err))
+			failed++
+			continue
+		}
+
+		if !rule.hasTag(s.tag) {
+			continue
+		}
+
+		if err := loadCohorts(conn, &rule); err != nil {
+			s.logger.Error(fmt.Sprintf("Failed to load user ids of rule %s (key=%s): %v", rule.Name, ruleKey, err))
+			failed++
+			continue
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return &ruleSet{rules: rules, failed: failed, source: source}, nil
+}
+
+// loadCohorts scans the userIdsKey sets of the rule and its leaf conditions
+// straight into their compiled user id sets. UserIds is left as configured, so
+// that the snapshot version does not re-encode every member; the set digests
+// are recorded instead.
+func loadCohorts(conn redis.Conn, rule *Rule) error {
+	return rule.walk(func(r *Rule) error {
+		if !r.loadsCohort() {
+			return nil
+		}
+		if r.compiled == nil {
+			if err := r.compile(); err != nil {
+				return err
+			}
+		}
+		digest, err := scanSet(conn, r.UserIdsKey, r.compiled.userIDs)
+		if err != nil {
+			return fmt.Errorf("%s: %w", r.UserIdsKey, err)
+		}
+		r.compiled.cohort = digest
+		return nil
+	})
+}
+
+// decodeRuleEntry decodes one {key, rule} pair of the snapshot script reply.
+// The rule is an HGETALL reply for hash rules or the JSON document for string
+// rules.
+func decodeRuleEntry(entry interface{}) (string, Rule, error) {
+	pair, err := redis.Values(entry, nil)
+	if err != nil || len(pair) != 2 {
+		return "", Rule{}, fmt.Errorf("unexpected snapshot entry %v", entry)
+	}
+	ruleKey, err := redis.String(pair[0], nil)
+	if err != nil {
+		return "", Rule{}, err
+	}
+	switch value := pair[1].(type) {
+	case []byte:
+		rule, err := parseRuleJSON(value)
+		return ruleKey, rule, err
+	case []interface{}:
+		rule, err := parseRule(value)
+		return ruleKey, rule, err
+	default:
+		return ruleKey, Rule{}, fmt.Errorf("unexpected rule reply %T", value)
+	}
+}
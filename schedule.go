@@ -0,0 +1,138 @@
+package request_marker
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// compiledSchedule is a Schedule with its days, clock times and timezone
+// resolved, ready to be checked on every request.
+type compiledSchedule struct {
+	days     [7]bool
+	allDays  bool
+	start    int // minutes since midnight
+	end      int // minutes since midnight, exclusive
+	allDay   bool
+	location *time.Location
+}
+
+func compileSchedule(s Schedule) (*compiledSchedule, error) {
+	c := &compiledSchedule{location: time.UTC, allDays: len(s.Days) == 0}
+	for _, day := range s.Days {
+		weekday, ok := weekdays[strings.ToLower(strings.TrimSpace(day))]
+		if !ok {
+			return nil, fmt.Errorf("invalid schedule day: %q", day)
+		}
+		c.days[weekday] = true
+	}
+
+	if s.Timezone != "" {
+		location, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule timezone %q: %w", s.Timezone, err)
+		}
+		c.location = location
+	}
+
+	if s.StartTime == "" && s.EndTime == "" {
+		c.allDay = true
+		return c, nil
+	}
+	start, err := parseClock(s.StartTime)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(s.EndTime)
+	if err != nil {
+		return nil, err
+	}
+	if start == end {
+		return nil, fmt.Errorf("schedule startTime and endTime cannot be equal")
+	}
+	c.start, c.end = start, end
+	return c, nil
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schedule time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether t falls inside the window. Windows whose end is
+// before their start cross midnight; the part after midnight belongs to the
+// day the window started on.
+func (c *compiledSchedule) contains(t time.Time) bool {
+	local := t.In(c.location)
+	if c.allDay {
+		return c.allDays || c.days[local.Weekday()]
+	}
+
+	minute := local.Hour()*60 + local.Minute()
+	day := local.Weekday()
+	if c.start < c.end {
+		if minute < c.start || minute >= c.end {
+			return false
+		}
+	} else {
+		switch {
+		case minute >= c.start:
+		case minute < c.end:
+			day = (day + 6) % 7
+		default:
+			return false
+		}
+	}
+	return c.allDays || c.days[day]
+}
+
+func parseTimestamp(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q, expected RFC3339", value)
+	}
+	return t, nil
+}
+
+// now returns the time rules are evaluated at. Tests inject a clock to move
+// rules in and out of their activation windows.
+func (mk *Marker) now() time.Time {
+	if mk.clock != nil {
+		return mk.clock()
+	}
+	return time.Now()
+}
+
+// activeAt reports whether the rule's activation window includes t. Rules
+// without startAt, endAt and schedules are always active.
+func (r Rule) activeAt(t time.Time) bool {
+	c := r.matchers()
+	if !c.startAt.IsZero() && t.Before(c.startAt) {
+		return false
+	}
+	if !c.endAt.IsZero() && !t.Before(c.endAt) {
+		return false
+	}
+	if len(c.schedules) == 0 {
+		return true
+	}
+	for _, schedule := range c.schedules {
+		if schedule.contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package request_marker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRuleActiveAt_StartAndEnd(t *testing.T) {
+	rule := Rule{
+		Name:        "campaign",
+		MarkerValue: "campaign",
+		Type:        RuleTypePath,
+		Path:        "/",
+		StartAt:     "2024-06-01T09:00:00+08:00",
+		EndAt:       "2024-06-08T00:00:00+08:00",
+	}
+	if err := rule.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := rule.compile(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		at       string
+		expected bool
+	}{
+		{"2024-06-01T08:59:59+08:00", false},
+		{"2024-06-01T09:00:00+08:00", true},
+		{"2024-06-07T23:59:59+08:00", true},
+		{"2024-06-08T00:00:00+08:00", false},
+	}
+
+	for _, tt := range tests {
+		at, _ := time.Parse(time.RFC3339, tt.at)
+		if got := rule.activeAt(at); got != tt.expected {
+			t.Errorf("activeAt(%s) = %v, expected %v", tt.at, got, tt.expected)
+		}
+	}
+}
+
+func TestRuleActiveAt_Schedules(t *testing.T) {
+	rule := Rule{
+		Name:        "office-hours",
+		MarkerValue: "office",
+		Type:        RuleTypePath,
+		Path:        "/",
+		Schedules: []Schedule{
+			{Days: []string{"mon", "tue", "wed", "thu", "fri"}, StartTime: "09:00", EndTime: "18:00", Timezone: "UTC"},
+			{Days: []string{"Saturday"}, StartTime: "22:00", EndTime: "02:00"},
+		},
+	}
+	if err := rule.compile(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		at       string
+		expected bool
+	}{
+		{"2024-06-03T09:00:00Z", true},  // Monday
+		{"2024-06-03T17:59:00Z", true},  // Monday
+		{"2024-06-03T18:00:00Z", false}, // Monday
+		{"2024-06-03T08:59:00Z", false}, // Monday
+		{"2024-06-08T10:00:00Z", false}, // Saturday
+		{"2024-06-08T23:00:00Z", true},  // Saturday night
+		{"2024-06-09T01:30:00Z", true},  // Saturday window past midnight
+		{"2024-06-09T23:00:00Z", false}, // Sunday night
+	}
+
+	for _, tt := range tests {
+		at, _ := time.Parse(time.RFC3339, tt.at)
+		if got := rule.activeAt(at); got != tt.expected {
+			t.Errorf("activeAt(%s) = %v, expected %v", tt.at, got, tt.expected)
+		}
+	}
+}
+
+func TestMarkerServeHTTP_ActivationWindows(t *testing.T) {
+	config := &Config{
+		Tag:       "api",
+		MarkerKey: "X-MARK",
+		StaticRules: []Rule{
+			{
+				Tag: "api", Name: "launch", Enable: true, Priority: 300, Type: RuleTypePath, Path: "/", MarkerValue: "launch",
+				StartAt: "2024-06-10T00:00:00Z",
+			},
+			{
+				Tag: "api", Name: "office-hours", Enable: true, Priority: 200, Type: RuleTypePath, Path: "/", MarkerValue: "office",
+				Schedules: []Schedule{{Days: []string{"mon"}, StartTime: "09:00", EndTime: "18:00", Timezone: "UTC"}},
+			},
+			{Tag: "api", Name: "default", Enable: true, Priority: 100, Type: RuleTypePath, Path: "/", MarkerValue: "default"},
+		},
+	}
+	handler, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	marker := handler.(*Marker)
+	var now time.Time
+	marker.clock = func() time.Time { return now }
+
+	// The same marker moves through the windows as time passes, without a refresh
+	tests := []struct {
+		at       string
+		expected string
+	}{
+		{"2024-06-03T08:59:00Z", "default"}, // Monday before office hours
+		{"2024-06-03T09:00:00Z", "office"},  // office hours open
+		{"2024-06-03T18:00:00Z", "default"}, // office hours closed
+		{"2024-06-10T09:30:00Z", "launch"},  // launch started and outranks office hours
+	}
+
+	for _, tt := range tests {
+		now, _ = time.Parse(time.RFC3339, tt.at)
+		req := httptest.NewRequest("GET", "/", nil)
+		marker.ServeHTTP(httptest.NewRecorder(), req)
+		if got := req.Header.Get("X-MARK"); got != tt.expected {
+			t.Errorf("%s: expected X-MARK=%q, got %q", tt.at, tt.expected, got)
+		}
+	}
+}
+
+func TestRuleValidate_Activation(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Rule
+		valid bool
+	}{
+		{"no window", Rule{}, true},
+		{"invalid startAt", Rule{StartAt: "tomorrow"}, false},
+		{"end before start", Rule{StartAt: "2024-06-02T00:00:00Z", EndAt: "2024-06-01T00:00:00Z"}, false},
+		{"invalid day", Rule{Schedules: []Schedule{{Days: []string{"someday"}}}}, false},
+		{"invalid time", Rule{Schedules: []Schedule{{StartTime: "9am", EndTime: "18:00"}}}, false},
+		{"invalid timezone", Rule{Schedules: []Schedule{{Timezone: "Mars/Olympus"}}}, false},
+	}
+
+	for _, tt := range tests {
+		tt.rule.Name = "rule"
+		tt.rule.MarkerValue = "mark"
+		tt.rule.Type = RuleTypePath
+		tt.rule.Path = "/"
+		err := tt.rule.Validate()
+		if tt.valid && err != nil {
+			t.Errorf("%s: expected no error, got %v", tt.name, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+package request_marker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed SemVer 2.0 version. Build metadata is dropped as it does
+// not take part in ordering.
+type semver struct {
+	major, minor, patch int
+	prerelease          []string
+}
+
+// parseSemver parses a version such as "2.1.0-beta.1+build.5". A leading "v"
+// is accepted and missing minor or patch parts default to zero, so "v2.1"
+// reads as 2.1.0.
+func parseSemver(value string) (semver, error) {
+	v, parts, wildcard, err := parsePartialSemver(value)
+	if err != nil {
+		return semver{}, err
+	}
+	if parts < 0 || wildcard {
+		return semver{}, fmt.Errorf("invalid version %q: wildcards are not allowed here", value)
+	}
+	return v, nil
+}
+
+// parsePartialSemver parses a version whose trailing parts may be missing or
+// wildcards ("x", "X", "*"). It returns how many numeric parts were given, or
+// -1 when a wildcard is followed by a number, and whether a wildcard was used.
+func parsePartialSemver(value string) (semver, int, bool, error) {
+	v := semver{}
+	s := strings.TrimSpace(value)
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "v"), "V")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		if err := validateIdentifiers(s[i+1:], false); err != nil {
+			return v, 0, false, fmt.Errorf("invalid build metadata in %q: %w", value, err)
+		}
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		if err := validateIdentifiers(s[i+1:], true); err != nil {
+			return v, 0, false, fmt.Errorf("invalid prerelease in %q: %w", value, err)
+		}
+		v.prerelease = strings.Split(s[i+1:], ".")
+		s = s[:i]
+	}
+	if s == "" {
+		return v, 0, false, fmt.Errorf("invalid version %q", value)
+	}
+
+	fields := strings.Split(s, ".")
+	if len(fields) > 3 {
+		return v, 0, false, fmt.Errorf("invalid version %q: too many parts", value)
+	}
+	numbers := [3]int{}
+	parts := 0
+	wildcard := false
+	for i, field := range fields {
+		if field == "x" || field == "X" || field == "*" {
+			wildcard = true
+			continue
+		}
+		if parts != i {
+			return v, -1, true, nil
+		}
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 0 || (len(field) > 1 && field[0] == '0') {
+			return v, 0, false, fmt.Errorf("invalid version %q: bad number %q", value, field)
+		}
+		numbers[i] = n
+		parts++
+	}
+	if v.prerelease != nil && parts < 3 {
+		return v, 0, false, fmt.Errorf("invalid version %q: prerelease requires major.minor.patch", value)
+	}
+	v.major, v.minor, v.patch = numbers[0], numbers[1], numbers[2]
+	return v, parts, wildcard, nil
+}
+
+func validateIdentifiers(s string, noLeadingZero bool) error {
+	for _, id := range strings.Split(s, ".") {
+		if id == "" {
+			return fmt.Errorf("empty identifier")
+		}
+		for _, ch := range id {
+			if !(ch >= '0' && ch <= '9' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch == '-') {
+				return fmt.Errorf("invalid character %q", ch)
+			}
+		}
+		if noLeadingZero && len(id) > 1 && id[0] == '0' && isNumeric(id) {
+			return fmt.Errorf("numeric identifier %q has a leading zero", id)
+		}
+	}
+	return nil
+}
+
+func isNumeric(s string) bool {
+	for _, ch := range s {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// compare orders versions by SemVer precedence: a prerelease sorts before its
+// release and prerelease identifiers compare numerically or lexically.
+func (v semver) compare(o semver) int {
+	if c := compareInt(v.major, o.major); c != 0 {
+		return c
+	}
+	if c := compareInt(v.minor, o.minor); c != 0 {
+		return c
+	}
+	if c := compareInt(v.patch, o.patch); c != 0 {
+		return c
+	}
+
+	switch {
+	case len(v.prerelease) == 0 && len(o.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(o.prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		a, b := v.prerelease[i], o.prerelease[i]
+		aNum, bNum := isNumeric(a), isNumeric(b)
+		switch {
+		case aNum && bNum:
+			x, _ := strconv.Atoi(a)
+			y, _ := strconv.Atoi(b)
+			if c := compareInt(x, y); c != 0 {
+				return c
+			}
+		case aNum:
+			return -1
+		case bNum:
+			return 1
+		default:
+			if c := strings.Compare(a, b); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInt(len(v.prerelease), len(o.prerelease))
+}
+
+func compareInt(a, b int) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// floor returns the lowest possible version of the given release, below all of
+// its prereleases. It is used as an exclusive upper bound for ranges such as
+// "3.1.x" so that 3.2.0-beta is not included.
+func floor(major, minor, patch int) semver {
+	return semver{major: major, minor: minor, patch: patch, prerelease: []string{"0"}}
+}
+
+type comparator struct {
+	op      string
+	version semver
+}
+
+func (c comparator) matches(v semver) bool {
+	cmp := v.compare(c.version)
+	switch c.op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case "!=":
+		return cmp != 0
+	default:
+		return cmp == 0
+	}
+}
+
+// versionConstraint is a disjunction ("||") of comparator sets that must all
+// hold, e.g. ">=2.0.0 <3.0.0 || 3.1.x".
+type versionConstraint [][]comparator
+
+func (vc versionConstraint) matches(v semver) bool {
+	for _, set := range vc {
+		matched := true
+		for _, c := range set {
+			if !c.matches(v) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+var constraintOperators = []string{">=", "<=", "!=", "==", ">", "<", "=", "~", "^"}
+
+func parseVersionConstraint(expr string) (versionConstraint, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, fmt.Errorf("empty version constraint")
+	}
+
+	var constraint versionConstraint
+	for _, group := range strings.Split(expr, "||") {
+		tokens := strings.Fields(strings.ReplaceAll(group, ",", " "))
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("invalid version constraint %q: empty alternative", expr)
+		}
+
+		set := []comparator{}
+		for i := 0; i < len(tokens); i++ {
+			token := tokens[i]
+			// Allow a space between the operator and the version, e.g. ">= 2.0.0"
+			if isOperator(token) && i+1 < len(tokens) {
+				token += tokens[i+1]
+				i++
+			}
+			comparators, err := parseComparator(token)
+			if err != nil {
+				return nil, fmt.Errorf("invalid version constraint %q: %w", expr, err)
+			}
+			set = append(set, comparators...)
+		}
+		constraint = append(constraint, set)
+	}
+	return constraint, nil
+}
+
+func isOperator(token string) bool {
+	for _, op := range constraintOperators {
+		if token == op {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardComparators expands a term that matches any version, which only
+// operators that include every version can be combined with.
+func wildcardComparators(op string) ([]comparator, error) {
+	if op == "" || op == "=" || op == ">=" || op == "<=" {
+		return []comparator{}, nil
+	}
+	return nil, fmt.Errorf("operator %s cannot be used with a wildcard", op)
+}
+
+// parseComparator expands a single term such as ">=2.0", "3.1.x", "~1.2.3" or
+// "^0.4" into plain comparators.
+func parseComparator(token string) ([]comparator, error) {
+	op := ""
+	for _, candidate := range constraintOperators {
+		if strings.HasPrefix(token, candidate) {
+			op = candidate
+			break
+		}
+	}
+	raw := token[len(op):]
+	if op == "==" {
+		op = "="
+	}
+
+	if raw == "*" || raw == "x" || raw == "X" {
+		return wildcardComparators(op)
+	}
+
+	v, parts, _, err := parsePartialSemver(raw)
+	if err != nil {
+		return nil, err
+	}
+	if parts < 0 {
+		return nil, fmt.Errorf("invalid version %q: a wildcard cannot be followed by a number", raw)
+	}
+	// x.x and *.*.* leave every part unspecified, just like a single *
+	if parts == 0 {
+		return wildcardComparators(op)
+	}
+
+	// next is the first release after the partially specified one, e.g. 3.2.0 for 3.1.x
+	next := func(parts int) semver {
+		switch parts {
+		case 1:
+			return floor(v.major+1, 0, 0)
+		case 2:
+			return floor(v.major, v.minor+1, 0)
+		}
+		return floor(v.major, v.minor, v.patch+1)
+	}
+
+	switch op {
+	case "", "=":
+		if parts == 3 {
+			return []comparator{{"=", v}}, nil
+		}
+		return []comparator{{">=", v}, {"<", next(parts)}}, nil
+	case "!=":
+		if parts != 3 {
+			return nil, fmt.Errorf("operator != requires a full version, got %q", raw)
+		}
+		return []comparator{{"!=", v}}, nil
+	case ">":
+		if parts == 3 {
+			return []comparator{{">", v}}, nil
+		}
+		return []comparator{{">=", next(parts)}}, nil
+	case ">=":
+		return []comparator{{">=", v}}, nil
+	case "<":
+		if parts == 3 {
+			return []comparator{{"<", v}}, nil
+		}
+		return []comparator{{"<", floor(v.major, v.minor, v.patch)}}, nil
+	case "<=":
+		if parts == 3 {
+			return []comparator{{"<=", v}}, nil
+		}
+		return []comparator{{"<", next(parts)}}, nil
+	case "~":
+		// ~1.2.3 := >=1.2.3 <1.3.0, ~1 := >=1.0.0 <2.0.0
+		if parts == 1 {
+			return []comparator{{">=", v}, {"<", next(1)}}, nil
+		}
+		return []comparator{{">=", v}, {"<", next(2)}}, nil
+	case "^":
+		// ^ allows changes that do not modify the left-most non-zero part
+		switch {
+		case v.major > 0 || parts == 1:
+			return []comparator{{">=", v}, {"<", next(1)}}, nil
+		case v.minor > 0 || parts == 2:
+			return []comparator{{">=", v}, {"<", next(2)}}, nil
+		default:
+			return []comparator{{">=", v}, {"<", next(3)}}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operator %q", op)
+}
+
+// compileVersionRange turns the bounds and constraint expression of a version
+// rule into a single constraint. Missing bounds leave the range open.
+func compileVersionRange(minVersion, maxVersion string, minExclusive, maxExclusive bool, expr string) (versionConstraint, error) {
+	bounds := []comparator{}
+	var lower, upper *semver
+	if minVersion != "" {
+		v, err := parseSemver(minVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid minVersion: %w", err)
+		}
+		op := ">="
+		if minExclusive {
+			op = ">"
+		}
+		bounds = append(bounds, comparator{op, v})
+		lower = &v
+	}
+	if maxVersion != "" {
+		v, err := parseSemver(maxVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid maxVersion: %w", err)
+		}
+		op := "<="
+		if maxExclusive {
+			op = "<"
+		}
+		bounds = append(bounds, comparator{op, v})
+		upper = &v
+	}
+	if lower != nil && upper != nil && lower.compare(*upper) > 0 {
+		return nil, fmt.Errorf("minVersion %s is greater than maxVersion %s", minVersion, maxVersion)
+	}
+
+	if expr == "" {
+		return versionConstraint{bounds}, nil
+	}
+	constraint, err := parseVersionConstraint(expr)
+	if err != nil {
+		return nil, err
+	}
+	// (bounds) AND (a || b) == (bounds AND a) || (bounds AND b)
+	for i := range constraint {
+		constraint[i] = append(append([]comparator{}, bounds...), constraint[i]...)
+	}
+	return constraint, nil
+}
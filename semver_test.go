@@ -0,0 +1,117 @@
+package request_marker
+
+import (
+	"testing"
+)
+
+func TestParseSemver(t *testing.T) {
+	valid := []string{"1.2.3", "v1.2.3", "V1.2", "1", "1.2.3-beta.1", "1.2.3-rc.1+build.5", "1.2.3+20240101"}
+	for _, v := range valid {
+		if _, err := parseSemver(v); err != nil {
+			t.Errorf("parseSemver(%q) unexpected error: %v", v, err)
+		}
+	}
+
+	invalid := []string{"", "v", "1.2.3.4", "a.b.c", "01.2.3", "1.2.3-", "1.2.3-beta..1", "1.2-beta", "1.x"}
+	for _, v := range invalid {
+		if _, err := parseSemver(v); err == nil {
+			t.Errorf("parseSemver(%q) expected error", v)
+		}
+	}
+}
+
+func TestSemverCompare_Precedence(t *testing.T) {
+	// SemVer 2.0 spec example, in ascending order
+	ordered := []string{
+		"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta",
+		"1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.1.0", "2.0.0",
+	}
+
+	for i := 0; i < len(ordered)-1; i++ {
+		a, _ := parseSemver(ordered[i])
+		b, _ := parseSemver(ordered[i+1])
+		if a.compare(b) != -1 || b.compare(a) != 1 {
+			t.Errorf("expected %s < %s", ordered[i], ordered[i+1])
+		}
+	}
+}
+
+func TestVersionConstraint_Matches(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		expected   bool
+	}{
+		{">=2.0.0 <3.0.0 || 3.1.x", "2.5.0", true},
+		{">=2.0.0 <3.0.0 || 3.1.x", "3.0.5", false},
+		{">=2.0.0 <3.0.0 || 3.1.x", "3.1.9", true},
+		{">=2.0.0 <3.0.0 || 3.1.x", "3.2.0-beta", false},
+		{">= 2.0.0, < 3.0.0", "2.0.0", true},
+		{">2.1", "2.1.9", false},
+		{">2.1", "2.2.0", true},
+		{"<=2.1", "2.1.9", true},
+		{"<2.1", "2.1.0-alpha", false},
+		{"~1.2.3", "1.2.9", true},
+		{"~1.2.3", "1.3.0", false},
+		{"^1.2.3", "1.9.0", true},
+		{"^1.2.3", "2.0.0", false},
+		{"^0.2.3", "0.3.0", false},
+		{"!=2.0.0", "2.0.0", false},
+		{"*", "0.0.1", true},
+		{"x.x", "1.2.3", true},
+		{"x.x.x", "5.0.0", true},
+		{"*.*.*", "0.0.0", true},
+		{">=x.x", "1.2.3", true},
+		{"<=*.*", "5.0.0", true},
+		{"2.0.0", "2.0.0+build", true},
+	}
+
+	for _, tt := range tests {
+		constraint, err := parseVersionConstraint(tt.constraint)
+		if err != nil {
+			t.Fatalf("parseVersionConstraint(%q) unexpected error: %v", tt.constraint, err)
+		}
+		v, err := parseSemver(tt.version)
+		if err != nil {
+			t.Fatalf("parseSemver(%q) unexpected error: %v", tt.version, err)
+		}
+		if got := constraint.matches(v); got != tt.expected {
+			t.Errorf("%q matches %q = %v, expected %v", tt.constraint, tt.version, got, tt.expected)
+		}
+	}
+}
+
+func TestVersionConstraint_Invalid(t *testing.T) {
+	for _, constraint := range []string{">x.x", "<x.x", ">*", "!=*.*.*", "~x.x", "1.x.2", ""} {
+		if _, err := parseVersionConstraint(constraint); err == nil {
+			t.Errorf("parseVersionConstraint(%q): expected an error", constraint)
+		}
+	}
+}
+
+func TestCompileVersionRange_Bounds(t *testing.T) {
+	tests := []struct {
+		min, max     string
+		minEx, maxEx bool
+		version      string
+		expected     bool
+	}{
+		{"2.0.0", "", false, false, "9.0.0", true},
+		{"2.0.0", "", true, false, "2.0.0", false},
+		{"", "2.9.9", false, false, "2.9.9", true},
+		{"", "3.0.0", false, true, "3.0.0", false},
+		{"", "3.0.0", false, true, "3.0.0-rc.1", true},
+		{"2.0.0", "2.9.9", false, false, "2.1.0-beta.1", true},
+	}
+
+	for _, tt := range tests {
+		constraint, err := compileVersionRange(tt.min, tt.max, tt.minEx, tt.maxEx, "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		v, _ := parseSemver(tt.version)
+		if got := constraint.matches(v); got != tt.expected {
+			t.Errorf("[%s,%s] ex=%v/%v matches %s = %v, expected %v", tt.min, tt.max, tt.minEx, tt.maxEx, tt.version, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package request_marker
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+)
+
+const (
+	ruleSourceStatic = "static"
+	ruleSourceRedis  = "redis"
+	ruleSourceFile   = "file"
+	ruleSourceHTTP   = "http"
+)
+
+// ruleSnapshot describes the rule set currently served. It is guarded by
+// Marker.mu together with config.StaticRules.
+type ruleSnapshot struct {
+	version   string
+	source    string
+	loadedAt  time.Time
+	lastError error
+	failures  int
+}
+
+// rulesVersion derives a content version from the rules, so that reloading an
+// unchanged rule set keeps its version. Cohorts loaded from userIdsKey sets
+// contribute their digests rather than their members.
+func rulesVersion(rules []Rule) string {
+	data, err := json.Marshal(rules)
+	if err != nil {
+		return "unknown"
+	}
+	h := fnv.New64a()
+	_, _ = h.Write(data)
+	for i := range rules {
+		_ = rules[i].walk(func(r *Rule) error {
+			if r.compiled != nil && r.loadsCohort() {
+				fmt.Fprintf(h, ":%016x", r.compiled.cohort)
+			}
+			return nil
+		})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// applySnapshot replaces the served rules with a freshly loaded set as a
+// whole, or rejects it according to the snapshot policy and keeps serving the
+// last known good rules.
+func (mk *Marker) applySnapshot(rules []Rule, failed int, source string) error {
+	policy := mk.config.SnapshotPolicy
+
+	if policy.Strict && failed > 0 {
+		err := fmt.Errorf("rejected %s snapshot: %d rules failed to load", source, failed)
+		mk.recordRefreshFailure(err)
+		return err
+	}
+
+	mk.mu.RLock()
+	previous := mk.snapshot
+	current := len(mk.config.StaticRules)
+	mk.mu.RUnlock()
+
+	// Only compare against a snapshot from the same source; the configured
+	// static rules are merely a fallback, and activating another rule set
+	// version is a deliberate change.
+	if policy.MaxDropPercent > 0 && previous.source == source && current > 0 &&
+		(current-len(rules))*100 > current*policy.MaxDropPercent {
+		err := fmt.Errorf("rejected %s snapshot: rule count dropped from %d to %d, more than %d%%", source, current, len(rules), policy.MaxDropPercent)
+		mk.recordRefreshFailure(err)
+		return err
+	}
+
+	sort.Sort(SortByPriority(rules))
+	version := rulesVersion(rules)
+
+	mk.mu.Lock()
+	mk.config.StaticRules = rules
+	mk.snapshot = ruleSnapshot{version: version, source: source, loadedAt: time.Now()}
+	mk.mu.Unlock()
+
+	if version != previous.version || source != previous.source {
+		mk.logger.Info(fmt.Sprintf("Applied rule snapshot %s from %s (%d rules, %d skipped)", version, source, len(rules), failed))
+	} else {
+		mk.logger.Debug(fmt.Sprintf("Loaded %d rules from %s, snapshot %s unchanged", len(rules), source, version))
+	}
+	return nil
+}
+
+// recordRefreshFailure keeps the served rules untouched and remembers why the
+// latest refresh did not replace them.
+func (mk *Marker) recordRefreshFailure(err error) {
+	mk.mu.Lock()
+	mk.snapshot.lastError = err
+	mk.snapshot.failures++
+	snapshot := mk.snapshot
+	mk.mu.Unlock()
+
+	mk.logger.Error(fmt.Sprintf("Keeping rule snapshot %s from %s loaded at %s: %v",
+		snapshot.version, snapshot.source, snapshot.loadedAt.Format(time.RFC3339), err))
+}
+
+// touchSnapshot records that the source was checked and still matches the
+// served rules, so that an unchanged rule file or a 304 does not turn stale.
+func (mk *Marker) touchSnapshot() {
+	mk.mu.Lock()
+	mk.snapshot.loadedAt = time.Now()
+	mk.snapshot.lastError = nil
+	mk.snapshot.failures = 0
+	mk.mu.Unlock()
+}
+
+// snapshotStale reports whether the served rules are older than staleAfter,
+// or are still the static fallback although dynamic loading is enabled.
+func (mk *Marker) snapshotStale(snapshot ruleSnapshot, now time.Time) bool {
+	if !dynamicRulesEnabled(mk.config) {
+		return false
+	}
+	if snapshot.source == ruleSourceStatic {
+		return true
+	}
+
+	staleAfter := time.Duration(mk.config.SnapshotPolicy.StaleAfter) * time.Second
+	if staleAfter <= 0 {
+		staleAfter = 3 * mk.dynamicRefreshInterval()
+	}
+	return now.Sub(snapshot.loadedAt) > staleAfter
+}
+
+func (mk *Marker) snapshotHeaderValue(snapshot ruleSnapshot, now time.Time) string {
+	return fmt.Sprintf("version=%s; source=%s; age=%d; stale=%t",
+		snapshot.version, snapshot.source, int64(now.Sub(snapshot.loadedAt)/time.Second), mk.snapshotStale(snapshot, now))
+}
@@ -0,0 +1,177 @@
+package request_marker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qxsugar/request-marker/redis"
+)
+
+func newSnapshotMarker(conn *fakeRedisConn, policy SnapshotPolicy) *Marker {
+	static := []Rule{{Name: "static", Enable: true, Type: RuleTypePath, MarkerValue: "static", Path: "/"}}
+	return &Marker{
+		next:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		logger: NewLogger("DEBUG"),
+		config: &Config{
+			MarkerKey:      "X-MARK",
+			StaticRules:    static,
+			SnapshotPolicy: policy,
+			RedisConfig:    RedisConfig{Enable: true, RuleListKeys: "rules", RefreshInterval: 10},
+		},
+		redisPool: &redis.Pool{Dial: func() (redis.Conn, error) { return conn, nil }},
+		snapshot:  ruleSnapshot{version: rulesVersion(static), source: ruleSourceStatic, loadedAt: time.Now()},
+	}
+}
+
+func snapshotConn(names ...string) *fakeRedisConn {
+	conn := &fakeRedisConn{lists: map[string][]string{}, hashes: map[string]map[string]string{}}
+	for _, name := range names {
+		key := "rule:" + name
+		conn.lists["rules"] = append(conn.lists["rules"], key)
+		conn.hashes[key] = map[string]string{
+			FieldName:      name,
+			FieldEnable:    "1",
+			FieldType:      "path",
+			FieldMarkValue: name,
+			FieldPath:      "/" + name,
+		}
+	}
+	return conn
+}
+
+func TestApplySnapshot_StrictRejectsPartialSnapshot(t *testing.T) {
+	conn := snapshotConn("a", "b")
+	conn.lists["rules"] = append(conn.lists["rules"], "rule:missing")
+
+	lenient := newSnapshotMarker(conn, SnapshotPolicy{})
+	if err := lenient.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(lenient.config.StaticRules) != 2 {
+		t.Errorf("expected 2 rules without strict policy, got %d", len(lenient.config.StaticRules))
+	}
+
+	strict := newSnapshotMarker(conn, SnapshotPolicy{Strict: true})
+	if err := strict.refreshConfig(); err == nil {
+		t.Fatalf("expected strict policy to reject the snapshot")
+	}
+	if len(strict.config.StaticRules) != 1 || strict.config.StaticRules[0].Name != "static" {
+		t.Errorf("expected static rules to be kept, got %v", strict.config.StaticRules)
+	}
+	if strict.snapshot.failures != 1 || strict.snapshot.lastError == nil {
+		t.Errorf("expected the failure to be recorded, got %+v", strict.snapshot)
+	}
+}
+
+func TestApplySnapshot_MaxDropPercent(t *testing.T) {
+	conn := snapshotConn("a", "b", "c", "d")
+	marker := newSnapshotMarker(conn, SnapshotPolicy{MaxDropPercent: 50})
+
+	// The first Redis snapshot replaces the static fallback regardless of size
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	conn.lists["rules"] = []string{"rule:a", "rule:b"}
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("expected a 50%% drop to be accepted, got %v", err)
+	}
+
+	conn.lists["rules"] = []string{"rule:a"}
+	marker.config.SnapshotPolicy.MaxDropPercent = 10
+	if err := marker.refreshConfig(); err == nil {
+		t.Errorf("expected a 50%% drop to be rejected with a 10%% limit")
+	}
+	if len(marker.config.StaticRules) != 2 {
+		t.Errorf("expected the last known good rules to be kept, got %d rules", len(marker.config.StaticRules))
+	}
+}
+
+func TestApplySnapshot_Version(t *testing.T) {
+	conn := snapshotConn("a", "b")
+	marker := newSnapshotMarker(conn, SnapshotPolicy{})
+
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first := marker.snapshot
+	if first.source != ruleSourceRedis || first.version == "" {
+		t.Fatalf("unexpected snapshot %+v", first)
+	}
+
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if marker.snapshot.version != first.version {
+		t.Errorf("expected unchanged rules to keep version %s, got %s", first.version, marker.snapshot.version)
+	}
+
+	conn.hashes["rule:b"][FieldPath] = "/other"
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if marker.snapshot.version == first.version {
+		t.Errorf("expected changed rules to get a new version")
+	}
+}
+
+func TestRefreshConfig_ActiveVersion(t *testing.T) {
+	conn := snapshotConn("a", "b")
+	conn.lists["rules:v1"] = []string{"rule:a"}
+	conn.lists["rules:v2"] = conn.lists["rules"]
+	conn.strings = map[string]string{"rules:active": "2"}
+	marker := newSnapshotMarker(conn, SnapshotPolicy{MaxDropPercent: 10})
+	marker.config.RedisConfig.ActiveVersionKey = "rules:active"
+
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(marker.config.StaticRules) != 2 || marker.snapshot.source != "redis:v2" {
+		t.Fatalf("expected 2 rules from redis:v2, got %d from %s", len(marker.config.StaticRules), marker.snapshot.source)
+	}
+
+	// Rolling back is a deliberate change and bypasses maxDropPercent
+	conn.strings["rules:active"] = "1"
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(marker.config.StaticRules) != 1 || marker.snapshot.source != "redis:v1" {
+		t.Fatalf("expected 1 rule from redis:v1, got %d from %s", len(marker.config.StaticRules), marker.snapshot.source)
+	}
+
+	delete(conn.strings, "rules:active")
+	if err := marker.refreshConfig(); err == nil {
+		t.Fatalf("expected a missing active version to fail the refresh")
+	}
+	if len(marker.config.StaticRules) != 1 || marker.snapshot.source != "redis:v1" {
+		t.Errorf("expected redis:v1 to be kept, got %s", marker.snapshot.source)
+	}
+}
+
+func TestMarkerServeHTTP_SnapshotHeader(t *testing.T) {
+	marker := newSnapshotMarker(snapshotConn("a"), SnapshotPolicy{Header: "X-Marker-Rules", StaleAfter: 60})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	marker.ServeHTTP(httptest.NewRecorder(), req)
+	header := req.Header.Get("X-Marker-Rules")
+	if !strings.Contains(header, "source=static") || !strings.Contains(header, "stale=true") {
+		t.Errorf("expected static fallback to be reported stale, got %q", header)
+	}
+
+	if err := marker.refreshConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	marker.ServeHTTP(httptest.NewRecorder(), req)
+	header = req.Header.Get("X-Marker-Rules")
+	if !strings.Contains(header, "version="+marker.snapshot.version) || !strings.Contains(header, "source=redis") || !strings.Contains(header, "stale=false") {
+		t.Errorf("unexpected snapshot header %q", header)
+	}
+
+	if !marker.snapshotStale(marker.snapshot, time.Now().Add(2*time.Minute)) {
+		t.Errorf("expected snapshot to be stale after staleAfter")
+	}
+}
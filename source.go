@@ -0,0 +1,97 @@
+package request_marker
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// ruleSet is a complete set of rules loaded from a dynamic source.
+type ruleSet struct {
+	rules  []Rule
+	failed int    // 读取或解析失败的规则数，由 snapshotPolicy 决定是否接受
+	source string // 快照来源，如 redis:v42
+	commit func() // 可选，规则集生效后记录来源的状态，如 ETag
+}
+
+// ruleSource loads rules from a dynamic source such as Redis, a file or an
+// HTTP service. load returns a nil set when the rules have not changed since
+// the last applied set; state that identifies the set should only be recorded
+// in commit, so that a rejected set is loaded and checked again next time.
+type ruleSource interface {
+	load() (*ruleSet, error)
+}
+
+func dynamicRulesEnabled(config *Config) bool {
+	return config.RedisConfig.Enable || config.FileConfig.Enable || config.HTTPConfig.Enable
+}
+
+func validateRuleSources(config *Config) error {
+	enabled := 0
+	for _, enable := range []bool{config.RedisConfig.Enable, config.FileConfig.Enable, config.HTTPConfig.Enable} {
+		if enable {
+			enabled++
+		}
+	}
+	if enabled > 1 {
+		return fmt.Errorf("only one of redisConfig, fileConfig and httpConfig can be enabled")
+	}
+	if config.FileConfig.Enable && config.FileConfig.Path == "" {
+		return fmt.Errorf("fileConfig requires path")
+	}
+	if config.HTTPConfig.Enable {
+		u, err := url.Parse(config.HTTPConfig.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("httpConfig requires an http or https url, got %q", config.HTTPConfig.URL)
+		}
+	}
+	return nil
+}
+
+func (mk *Marker) dynamicRefreshInterval() time.Duration {
+	switch {
+	case mk.config.FileConfig.Enable:
+		return refreshInterval(mk.config.FileConfig.RefreshInterval)
+	case mk.config.HTTPConfig.Enable:
+		return refreshInterval(mk.config.HTTPConfig.RefreshInterval)
+	}
+	return refreshInterval(mk.config.RedisConfig.RefreshInterval)
+}
+
+func (mk *Marker) newRuleSource() ruleSource {
+	switch {
+	case mk.config.FileConfig.Enable:
+		return &fileSource{config: mk.config.FileConfig, tag: mk.config.Tag}
+	case mk.config.HTTPConfig.Enable:
+		return newHTTPSource(mk.config.HTTPConfig, mk.config.Tag)
+	}
+	return &redisSource{pool: mk.redisPool, config: mk.config.RedisConfig, tag: mk.config.Tag, logger: mk.logger}
+}
+
+// refreshConfig loads rules from the dynamic source and swaps them in as a
+// whole, or keeps the served rules if loading fails or the snapshot policy
+// rejects them. The source is built from the configuration on first use.
+func (mk *Marker) refreshConfig() error {
+	if mk.source == nil {
+		mk.source = mk.newRuleSource()
+	}
+
+	set, err := mk.source.load()
+	if err != nil {
+		mk.recordRefreshFailure(err)
+		return err
+	}
+	if set == nil {
+		mk.logger.Debug("Rules unchanged at source")
+		mk.touchSnapshot()
+		return nil
+	}
+
+	if err := mk.applySnapshot(set.rules, set.failed, set.source); err != nil {
+		return err
+	}
+	if set.commit != nil {
+		set.commit()
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package request_marker
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestValidateRuleSources(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{"none", Config{}, false},
+		{"redis", Config{RedisConfig: RedisConfig{Enable: true}}, false},
+		{"file", Config{FileConfig: FileConfig{Enable: true, Path: "rules.yaml"}}, false},
+		{"http", Config{HTTPConfig: HTTPConfig{Enable: true, URL: "https://experiments.internal/rules"}}, false},
+		{"file without path", Config{FileConfig: FileConfig{Enable: true}}, true},
+		{"http without url", Config{HTTPConfig: HTTPConfig{Enable: true}}, true},
+		{"http with relative url", Config{HTTPConfig: HTTPConfig{Enable: true, URL: "/rules"}}, true},
+		{"file and redis", Config{FileConfig: FileConfig{Enable: true, Path: "rules.yaml"}, RedisConfig: RedisConfig{Enable: true}}, true},
+		{"http and file", Config{HTTPConfig: HTTPConfig{Enable: true, URL: "http://rules"}, FileConfig: FileConfig{Enable: true, Path: "rules.yaml"}}, true},
+	}
+
+	for _, tt := range tests {
+		if err := validateRuleSources(&tt.config); (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
+
+// stubSource replays a fixed sequence of load results.
+type stubSource struct {
+	sets      []*ruleSet
+	errs      []error
+	committed int
+}
+
+func (s *stubSource) load() (*ruleSet, error) {
+	set, err := s.sets[0], s.errs[0]
+	s.sets, s.errs = s.sets[1:], s.errs[1:]
+	if set != nil {
+		set.commit = func() { s.committed++ }
+	}
+	return set, err
+}
+
+func TestRefreshConfig_RuleSource(t *testing.T) {
+	rules := func(names ...string) []Rule {
+		var rules []Rule
+		for _, name := range names {
+			rules = append(rules, Rule{Name: name, Enable: true, Type: RuleTypePath, Path: "/" + name, MarkerValue: name})
+		}
+		return rules
+	}
+	source := &stubSource{
+		sets: []*ruleSet{{rules: rules("a", "b"), source: "stub"}, nil, nil, {rules: rules("c"), failed: 1, source: "stub"}},
+		errs: []error{nil, nil, errors.New("unreachable"), nil},
+	}
+	marker := &Marker{
+		next:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		logger: NewLogger("DEBUG"),
+		config: &Config{MarkerKey: "X-MARK", SnapshotPolicy: SnapshotPolicy{Strict: true}},
+		source: source,
+	}
+
+	if err := marker.refreshConfig(); err != nil || len(marker.config.StaticRules) != 2 || source.committed != 1 {
+		t.Fatalf("expected the first set to be applied and committed, got %v, %d rules", err, len(marker.config.StaticRules))
+	}
+	if err := marker.refreshConfig(); err != nil || len(marker.config.StaticRules) != 2 {
+		t.Fatalf("expected unchanged rules to be kept, got %v", err)
+	}
+	if err := marker.refreshConfig(); err == nil || marker.snapshot.failures != 1 {
+		t.Fatalf("expected a load error to be recorded, got %v", err)
+	}
+	if err := marker.refreshConfig(); err == nil || len(marker.config.StaticRules) != 2 || source.committed != 1 {
+		t.Errorf("expected a rejected set to be neither applied nor committed, got %v", err)
+	}
+}
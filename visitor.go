@@ -0,0 +1,111 @@
+package request_marker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultVisitorCookieName = "marker_vid"
+
+type visitorIDKey struct{}
+
+func (c VisitorCookieConfig) cookieName() string {
+	if c.Name == "" {
+		return defaultVisitorCookieName
+	}
+	return c.Name
+}
+
+func validateVisitorCookie(config VisitorCookieConfig) error {
+	if !config.Enable {
+		return nil
+	}
+	if config.TTL < 0 {
+		return fmt.Errorf("visitor cookie ttl must not be negative")
+	}
+	if _, err := parseSameSite(config.SameSite); err != nil {
+		return err
+	}
+	if strings.EqualFold(config.SameSite, "none") && !config.Secure {
+		return fmt.Errorf("visitor cookie with sameSite none must be secure")
+	}
+	return nil
+}
+
+func parseSameSite(value string) (http.SameSite, error) {
+	switch strings.ToLower(value) {
+	case "":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("invalid visitor cookie sameSite: %s", value)
+	}
+}
+
+// assignVisitor mints a visitor ID cookie for requests that carry neither a
+// user identity nor a visitor cookie yet. The new ID is set on the response
+// and attached to the request context so that the current request is
+// bucketed the same way as the following ones.
+func (mk *Marker) assignVisitor(w http.ResponseWriter, req *http.Request) *http.Request {
+	config := mk.config.VisitorCookie
+	if !config.Enable {
+		return req
+	}
+	if _, err := mk.extractIdentify(req); err == nil {
+		return req
+	}
+	if cookie, err := req.Cookie(config.cookieName()); err == nil && cookie.Value != "" {
+		return req
+	}
+
+	id, err := randomID()
+	if err != nil {
+		mk.logger.Error(fmt.Sprintf("Failed to generate visitor id: %v", err))
+		return req
+	}
+
+	sameSite, _ := parseSameSite(config.SameSite)
+	cookie := &http.Cookie{
+		Name:     config.cookieName(),
+		Value:    id,
+		Path:     config.Path,
+		Domain:   config.Domain,
+		Secure:   config.Secure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	}
+	if cookie.Path == "" {
+		cookie.Path = "/"
+	}
+	if config.TTL > 0 {
+		cookie.MaxAge = int(config.TTL)
+		cookie.Expires = time.Now().Add(time.Duration(config.TTL) * time.Second)
+	}
+	http.SetCookie(w, cookie)
+	mk.logger.Debug(fmt.Sprintf("Assigned visitor id cookie: %s", cookie.Name))
+
+	return req.WithContext(context.WithValue(req.Context(), visitorIDKey{}, id))
+}
+
+// visitorID returns the visitor ID minted for this request, or the one sent
+// back by the browser in the visitor cookie.
+func (mk *Marker) visitorID(req *http.Request) string {
+	if !mk.config.VisitorCookie.Enable {
+		return ""
+	}
+	if id, ok := req.Context().Value(visitorIDKey{}).(string); ok && id != "" {
+		return id
+	}
+	if cookie, err := req.Cookie(mk.config.VisitorCookie.cookieName()); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
@@ -0,0 +1,131 @@
+package request_marker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newVisitorMarker(t *testing.T, visitor VisitorCookieConfig) http.Handler {
+	config := &Config{
+		Tag:            "api",
+		LogLevel:       "DEBUG",
+		MarkerKey:      "X-MARK",
+		IdentifyHeader: "X-User-ID",
+		VisitorCookie:  visitor,
+		StaticRules: []Rule{
+			{
+				Tag:      "api",
+				Name:     "ab",
+				Enable:   true,
+				Priority: 100,
+				Type:     RuleTypeSplit,
+				Variants: []Variant{{Value: "a", Weight: 50}, {Value: "b", Weight: 50}},
+			},
+		},
+	}
+
+	handler, err := New(context.Background(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), config, "test")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return handler
+}
+
+func TestMarkerServeHTTP_VisitorCookieMinted(t *testing.T) {
+	handler := newVisitorMarker(t, VisitorCookieConfig{
+		Enable:   true,
+		Name:     "vid",
+		TTL:      3600,
+		Domain:   "example.com",
+		Secure:   true,
+		SameSite: "None",
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	cookies := rw.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected one cookie, got %d", len(cookies))
+	}
+	cookie := cookies[0]
+	if cookie.Name != "vid" || cookie.Value == "" {
+		t.Fatalf("unexpected visitor cookie: %v", cookie)
+	}
+	if cookie.MaxAge != 3600 || cookie.Domain != "example.com" || cookie.Path != "/" || !cookie.Secure || cookie.SameSite != http.SameSiteNoneMode {
+		t.Errorf("unexpected visitor cookie attributes: %v", cookie)
+	}
+
+	mark := req.Header.Get("X-MARK")
+	if mark != "a" && mark != "b" {
+		t.Fatalf("expected first request to be bucketed, got %q", mark)
+	}
+
+	// Subsequent requests carrying the cookie must stay in the same variant
+	for i := 0; i < 20; i++ {
+		next := httptest.NewRequest("GET", "/", nil)
+		next.AddCookie(&http.Cookie{Name: "vid", Value: cookie.Value})
+		nextRW := httptest.NewRecorder()
+		handler.ServeHTTP(nextRW, next)
+
+		if got := next.Header.Get("X-MARK"); got != mark {
+			t.Fatalf("expected sticky variant %s, got %s", mark, got)
+		}
+		if len(nextRW.Result().Cookies()) != 0 {
+			t.Fatalf("expected no new cookie when visitor cookie is present")
+		}
+	}
+}
+
+func TestMarkerServeHTTP_VisitorCookieSkippedForUsers(t *testing.T) {
+	handler := newVisitorMarker(t, VisitorCookieConfig{Enable: true})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-User-ID", "user001")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	if len(rw.Result().Cookies()) != 0 {
+		t.Errorf("expected no visitor cookie for identified user")
+	}
+}
+
+func TestMarkerServeHTTP_VisitorCookieDisabled(t *testing.T) {
+	handler := newVisitorMarker(t, VisitorCookieConfig{})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	if len(rw.Result().Cookies()) != 0 {
+		t.Errorf("expected no visitor cookie when disabled")
+	}
+	if req.Header.Get("X-MARK") != "" {
+		t.Errorf("expected anonymous request to stay unmarked, got %s", req.Header.Get("X-MARK"))
+	}
+}
+
+func TestValidateVisitorCookie(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  VisitorCookieConfig
+		wantErr bool
+	}{
+		{"disabled", VisitorCookieConfig{SameSite: "bogus"}, false},
+		{"defaults", VisitorCookieConfig{Enable: true}, false},
+		{"strict", VisitorCookieConfig{Enable: true, SameSite: "strict"}, false},
+		{"invalid same site", VisitorCookieConfig{Enable: true, SameSite: "bogus"}, true},
+		{"none without secure", VisitorCookieConfig{Enable: true, SameSite: "none"}, true},
+		{"negative ttl", VisitorCookieConfig{Enable: true, TTL: -1}, true},
+	}
+
+	for _, tt := range tests {
+		err := validateVisitorCookie(tt.config)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
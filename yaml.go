@@ -0,0 +1,23 @@
+package request_marker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+)
+
+// decodeRuleFileYAML decodes a YAML rule file straight into ruleFile, using the
+// yaml tags that mirror the json tags of Rule. Decoding into the typed struct
+// keeps plain scalars such as userIds: [1001, 1002] or minVersion: 3 valid for
+// string fields.
+func decodeRuleFileYAML(data []byte) (ruleFile, error) {
+	var file ruleFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return ruleFile{}, fmt.Errorf("failed to decode rules: %w", err)
+	}
+	return file, nil
+}
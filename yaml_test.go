@@ -0,0 +1,52 @@
+package request_marker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeRuleFileYAML(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected Rule
+	}{
+		{"numeric user ids", "rules:\n  - type: identify\n    userIds: [1001, 1002]", Rule{Type: RuleTypeIdentify, UserIds: []string{"1001", "1002"}}},
+		{"numeric versions", "rules:\n  - type: version\n    minVersion: 3\n    maxVersion: 3.0", Rule{Type: RuleTypeVersion, MinVersion: "3", MaxVersion: "3.0"}},
+		{"numeric values", "rules:\n  - type: header\n    key: X-Tier\n    values:\n      - 1", Rule{Type: RuleTypeHeader, Key: "X-Tier", Values: []string{"1"}}},
+		{"typed fields", "rules:\n  - {type: canary, enable: true, priority: 10, canary: 30, buckets: [{from: 0, to: 500}]}", Rule{Type: RuleTypeCanary, Enable: true, Priority: 10, Canary: 30, Buckets: []BucketRange{{From: 0, To: 500}}}},
+		{"comments and quotes", "rules:\n  - type: path # trailing\n    path: \"/a#b\"\n    markerValue: 'it''s'", Rule{Type: RuleTypePath, Path: "/a#b", MarkerValue: "it's"}},
+		{"condition leaf", "rules:\n  - type: composite\n    conditions:\n      not:\n        type: path\n        path: /x", Rule{Type: RuleTypeComposite, Conditions: &Condition{Not: &Condition{Rule: Rule{Type: RuleTypePath, Path: "/x"}}}}},
+	}
+
+	for _, tt := range tests {
+		file, err := decodeRuleFileYAML([]byte(tt.input))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if len(file.Rules) != 1 || !reflect.DeepEqual(file.Rules[0], tt.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tt.name, tt.expected, file.Rules)
+		}
+	}
+}
+
+func TestDecodeRuleFileYAML_Errors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"unknown field", "rules:\n  - markValue: a"},
+		{"unknown leaf field", "rules:\n  - conditions: {not: {type: path, paths: /a}}"},
+		{"duplicate key", "rules:\n  - name: a\n    name: b"},
+		{"tab indentation", "rules:\n\t- name: a"},
+		{"unterminated flow", "rules: [{name: a}"},
+		{"wrong type", "rules:\n  - priority: high"},
+	}
+
+	for _, tt := range tests {
+		if _, err := decodeRuleFileYAML([]byte(tt.input)); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}